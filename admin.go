@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const redacted = "<redacted>"
+
+// requireAdmin guards an admin handler with the -adminToken bearer token.
+// Without a configured token the handler is served unprotected.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if opts.AdminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(opts.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// requireAllowedIP restricts a sensitive handler to clients within
+// -adminAllowCIDR. Without a configured list every client is allowed.
+func requireAllowedIP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(opts.AdminAllowCIDRs) > 0 && !ipAllowed(r.RemoteAddr, opts.AdminAllowCIDRs) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func ipAllowed(remoteAddr string, prefixes []netip.Prefix) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs and plain IPs.
+func parseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range splitList(s) {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+type configEndpoint struct {
+	URL       string   `json:"url"`
+	AccountID string   `json:"accountID"`
+	ProjectID string   `json:"projectID"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+type configRoute struct {
+	Path          string `json:"path"`
+	Format        string `json:"format"`
+	MergeStrategy string `json:"mergeStrategy"`
+}
+
+type configDump struct {
+	Endpoints []configEndpoint  `json:"endpoints"`
+	Routes    []configRoute     `json:"routes"`
+	Flags     map[string]string `json:"flags"`
+}
+
+// configHandler returns the loaded endpoints, routes and flags as JSON.
+func configHandler(endpoints []Endpoint, fs *flag.FlagSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+
+		dump := configDump{
+			Endpoints: make([]configEndpoint, 0, len(endpoints)),
+			Routes:    make([]configRoute, 0, len(routes)),
+			Flags:     map[string]string{},
+		}
+		for _, ep := range endpoints {
+			dump.Endpoints = append(dump.Endpoints, configEndpoint{
+				URL:       redactURL(ep.URL),
+				AccountID: ep.AccountID,
+				ProjectID: ep.ProjectID,
+				Tags:      ep.Tags,
+			})
+		}
+		for _, route := range routes {
+			dump.Routes = append(dump.Routes, configRoute{
+				Path:          route.Path,
+				Format:        route.Format.String(),
+				MergeStrategy: route.MergeStrategy.String(),
+			})
+		}
+		fs.VisitAll(func(f *flag.Flag) {
+			dump.Flags[f.Name] = redactFlag(f.Name, f.Value.String())
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dump); err != nil {
+			log.Printf("failed to write response: %v", err)
+		}
+	}
+}
+
+// redactFlag hides secret flag values and passwords in URL values.
+func redactFlag(name, value string) string {
+	lower := strings.ToLower(name)
+	if value != "" && (strings.Contains(lower, "token") || strings.Contains(lower, "password")) {
+		return redacted
+	}
+	parts := strings.Split(value, ",")
+	for i, p := range parts {
+		parts[i] = redactURL(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+// redactURL replaces the password of a URL with "xxxxx".
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// statusHandler returns latency, errors and circuit breaker state of every
+// endpoint as JSON.
+func statusHandler(endpoints []Endpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(endpointHealth.snapshot(endpoints)); err != nil {
+			log.Printf("failed to write response: %v", err)
+		}
+	}
+}
+
+// resetHandler closes all circuit breakers, e.g. after a backend recovered.
+// There is no response cache yet, so breakers are the only state it clears.
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n := endpointHealth.resetBreakers()
+	log.Printf("reset %d circuit breakers", n)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"breakersReset": n}); err != nil {
+		log.Printf("failed to write response: %v", err)
+	}
+}
+
+// queryHandler forwards a query to the single endpoint named by _endpoint,
+// either its URL, its tenant as accountID:projectID or both as in /status,
+// and returns the raw response without merging, e.g.
+// /-/query/select/logsql/query?_endpoint=http://node1:9428&query=*.
+func queryHandler(endpoints []Endpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+
+		_, path, _ := strings.Cut(r.URL.Path, "/-/query")
+		i := slices.IndexFunc(routes, func(route Route) bool { return route.Path == path })
+		if i < 0 {
+			http.Error(w, fmt.Sprintf("unknown route %q", path), http.StatusNotFound)
+			return
+		}
+		// disabled routes are not registered, don't reach them this way either
+		if slices.Contains(opts.DisabledRoutes, path) {
+			http.Error(w, fmt.Sprintf("route %q disabled", path), http.StatusNotFound)
+			return
+		}
+
+		names := takeQueryParam(r, "_endpoint")
+		if len(names) != 1 {
+			http.Error(w, "exactly one _endpoint is required", http.StatusBadRequest)
+			return
+		}
+		var matched []Endpoint
+		for _, ep := range endpoints {
+			if names[0] == ep.URL || names[0] == ep.AccountID+":"+ep.ProjectID || names[0] == ep.String() {
+				matched = append(matched, ep)
+			}
+		}
+		switch {
+		case len(matched) == 0:
+			http.Error(w, fmt.Sprintf("unknown endpoint %q in _endpoint", names[0]), http.StatusBadRequest)
+			return
+		case len(matched) > 1:
+			http.Error(w, fmt.Sprintf("_endpoint %q matches %d endpoints", names[0], len(matched)), http.StatusBadRequest)
+			return
+		}
+
+		results, err := getEndpointData(r, path, matched)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		res := results[0]
+		if res.StatusCode == 0 {
+			http.Error(w, res.Err.Error(), http.StatusBadGateway)
+			return
+		}
+		if routes[i].Format == JSON {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.WriteHeader(res.StatusCode)
+		if _, err := w.Write(res.Body); err != nil {
+			log.Printf("failed to write response: %v", err)
+		}
+	}
+}
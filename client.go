@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// httpClient is the shared client used for all backend requests.
+var httpClient = http.DefaultClient
+
+// newHTTPClient builds the backend client from the given options.
+func newHTTPClient(o Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if o.ProxyURL != "" {
+		proxy, err := url.Parse(o.ProxyURL)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid -proxyURL %q", o.ProxyURL)
+		}
+		bypass := parseNoProxy(o.NoProxy)
+		transport.Proxy = func(r *http.Request) (*url.URL, error) {
+			if bypass.match(r.URL) {
+				return nil, nil
+			}
+			return proxy, nil
+		}
+	}
+
+	if o.BackendTLSCertFile != "" || o.BackendTLSKeyFile != "" || o.BackendTLSCAFile != "" {
+		tlsConfig, err := newBackendTLSConfig(o.BackendTLSCertFile, o.BackendTLSKeyFile, o.BackendTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	protocols := new(http.Protocols)
+	switch o.BackendHTTP2 {
+	case "off":
+		protocols.SetHTTP1(true)
+		transport.ForceAttemptHTTP2 = false
+	case "h2c":
+		// without HTTP/1 the transport uses prior-knowledge HTTP/2 for
+		// http:// URLs
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	}
+	transport.Protocols = protocols
+
+	if o.BackendMaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = o.BackendMaxIdleConnsPerHost
+		if transport.MaxIdleConns < o.BackendMaxIdleConnsPerHost {
+			transport.MaxIdleConns = o.BackendMaxIdleConnsPerHost
+		}
+	}
+
+	if o.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   o.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// newBackendTLSConfig returns the TLS config for backend requests. The client
+// certificate authenticates the proxy against mTLS-protected storage nodes,
+// the CA file verifies their server certificates.
+func newBackendTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("-backendTLSCertFile and -backendTLSKeyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load backend client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read backend CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// noProxy is a parsed NO_PROXY-style bypass list.
+type noProxy struct {
+	all   bool
+	nets  []*net.IPNet
+	hosts []string
+}
+
+// parseNoProxy parses a comma-separated list of hosts, domains, IPs and
+// CIDRs. A domain matches itself and its subdomains, a leading dot only
+// matches subdomains and "*" matches everything.
+func parseNoProxy(s string) noProxy {
+	var np noProxy
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			np.all = true
+		case strings.Contains(entry, "/"):
+			if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+				np.nets = append(np.nets, ipnet)
+			}
+		default:
+			np.hosts = append(np.hosts, entry)
+		}
+	}
+	return np
+}
+
+func (np noProxy) match(u *url.URL) bool {
+	if np.all {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	hostPort := strings.ToLower(u.Host)
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range np.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	for _, h := range np.hosts {
+		if strings.Contains(h, ":") && net.ParseIP(h) == nil {
+			// entry with port must match host:port exactly
+			if h == hostPort {
+				return true
+			}
+			continue
+		}
+		if strings.HasPrefix(h, ".") {
+			if strings.HasSuffix(host, h) {
+				return true
+			}
+			continue
+		}
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
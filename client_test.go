@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClient_proxy(t *testing.T) {
+	var gotHost, gotAccount string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		gotAccount = r.Header.Get("AccountID")
+		_, err := io.WriteString(w, `{"values":[]}`)
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer proxy.Close()
+
+	client, err := newHTTPClient(Options{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("newHTTPClient() failed: %v", err)
+	}
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = client
+
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: "http://vlstorage.invalid:9428"}}
+	req := httptest.NewRequest("POST", "/select/logsql/field_names", bytes.NewBuffer([]byte("query=*")))
+
+	results, err := getEndpointData(req, "/select/logsql/field_names", endpoints)
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	if results[0].Err != nil {
+		t.Fatalf("request via proxy failed: %v", results[0].Err)
+	}
+	if gotHost != "vlstorage.invalid:9428" {
+		t.Errorf("expected request for vlstorage.invalid:9428 via proxy, got host %q", gotHost)
+	}
+	if gotAccount != "1" {
+		t.Errorf("expected AccountID header to reach proxy, got %q", gotAccount)
+	}
+}
+
+func TestNewHTTPClient_invalidProxy(t *testing.T) {
+	if _, err := newHTTPClient(Options{ProxyURL: "::not a url"}); err == nil {
+		t.Error("expected error for invalid proxy URL")
+	}
+}
+
+func TestNoProxyMatch(t *testing.T) {
+	tests := []struct {
+		noProxy string
+		url     string
+		want    bool
+	}{
+		{"", "http://node1:9428", false},
+		{"*", "http://node1:9428", true},
+		{"node1", "http://node1:9428", true},
+		{"example.com", "http://vl.example.com", true},
+		{"example.com", "http://example.com", true},
+		{".example.com", "http://example.com", false},
+		{".example.com", "http://vl.example.com", true},
+		{"node1:9428", "http://node1:9428", true},
+		{"node1:9428", "http://node1:9429", false},
+		{"10.0.0.0/8", "http://10.1.2.3:9428", true},
+		{"10.0.0.0/8", "http://192.168.1.1:9428", false},
+		{"node2, 10.0.0.1", "http://10.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatalf("url.Parse(%q) failed: %v", tt.url, err)
+		}
+		if got := parseNoProxy(tt.noProxy).match(u); got != tt.want {
+			t.Errorf("noProxy %q match %q = %v, want %v", tt.noProxy, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestNewHTTPClient_mTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey := writeSelfSignedCert(t, dir, "client")
+
+	clientPEM, err := os.ReadFile(clientCert)
+	if err != nil {
+		t.Fatalf("reading client cert failed: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"k":"v"}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	serverPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, serverPEM, 0o600); err != nil {
+		t.Fatalf("writing CA file failed: %v", err)
+	}
+
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	tests := []struct {
+		comment string
+		opts    Options
+		wantErr bool
+	}{
+		{"without client cert", Options{BackendTLSCAFile: caFile}, true},
+		{"with client cert", Options{BackendTLSCertFile: clientCert, BackendTLSKeyFile: clientKey, BackendTLSCAFile: caFile}, false},
+	}
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	for _, tt := range tests {
+		client, err := newHTTPClient(tt.opts)
+		if err != nil {
+			t.Fatalf("%s: newHTTPClient() failed: %v", tt.comment, err)
+		}
+		httpClient = client
+
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+		if err != nil {
+			t.Fatalf("%s: getEndpointData() failed: %v", tt.comment, err)
+		}
+		if (results[0].Err != nil) != tt.wantErr {
+			t.Errorf("%s: backend error = %v, wantErr %v", tt.comment, results[0].Err, tt.wantErr)
+		}
+	}
+
+	if _, err := newHTTPClient(Options{BackendTLSCertFile: clientCert}); err == nil {
+		t.Error("expected error for cert without key")
+	}
+}
+
+func TestNewHTTPClient_http2(t *testing.T) {
+	var gotProto string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotProto = r.Proto
+		_, err := io.WriteString(w, `{"values":[]}`)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	})
+
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	serverPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	if err := os.WriteFile(caFile, serverPEM, 0o600); err != nil {
+		t.Fatalf("writing CA file failed: %v", err)
+	}
+
+	h2cServer := httptest.NewUnstartedServer(handler)
+	h2cServer.Config.Protocols = new(http.Protocols)
+	h2cServer.Config.Protocols.SetHTTP1(true)
+	h2cServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cServer.Start()
+	defer h2cServer.Close()
+
+	tests := []struct {
+		mode string
+		url  string
+		want string
+	}{
+		{"", tlsServer.URL, "HTTP/2.0"},
+		{"off", tlsServer.URL, "HTTP/1.1"},
+		{"h2c", h2cServer.URL, "HTTP/2.0"},
+		{"", h2cServer.URL, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		client, err := newHTTPClient(Options{BackendHTTP2: tt.mode, BackendTLSCAFile: caFile, BackendMaxIdleConnsPerHost: 16})
+		if err != nil {
+			t.Fatalf("newHTTPClient() failed: %v", err)
+		}
+		resp, err := client.Post(tt.url+"/select/logsql/field_names", "application/x-www-form-urlencoded", bytes.NewBufferString("query=*"))
+		if err != nil {
+			t.Fatalf("%q %s: request failed: %v", tt.mode, tt.url, err)
+		}
+		_ = resp.Body.Close()
+		if gotProto != tt.want {
+			t.Errorf("%q %s: backend got %s, want %s", tt.mode, tt.url, gotProto, tt.want)
+		}
+	}
+}
+
+func TestNewHTTPClient_connectTimeout(t *testing.T) {
+	setOpts(t, func(o *Options) { o.RequestTimeout = time.Minute })
+	client, err := newHTTPClient(Options{ConnectTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("newHTTPClient() failed: %v", err)
+	}
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = client
+
+	// TEST-NET-1 is not routed, so the connection never completes
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: "http://192.0.2.1:9428"}}
+	req := httptest.NewRequest("POST", "/select/logsql/field_names", bytes.NewBuffer([]byte("query=*")))
+
+	start := time.Now()
+	results, err := getEndpointData(req, "/select/logsql/field_names", endpoints)
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	if results[0].Err == nil {
+		t.Fatal("expected the unreachable endpoint to fail")
+	}
+	// a host without a route or with a firewall rejects the dial at once,
+	// which leaves the timeout untested
+	for _, errno := range []syscall.Errno{syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.ECONNREFUSED} {
+		if errors.Is(results[0].Err, errno) {
+			t.Skipf("TEST-NET-1 is rejected on this host: %v", results[0].Err)
+		}
+	}
+	var netErr net.Error
+	if !errors.As(results[0].Err, &netErr) || !netErr.Timeout() {
+		t.Errorf("got %v, want a connect timeout", results[0].Err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("failed after %v, want about the connect timeout", elapsed)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// nodeLimits caps the in-flight requests per storage node if
+// -maxConcurrencyPerNode is set, so a slow node piles up its own requests
+// without holding back the others.
+var nodeLimits = &nodeLimiter{}
+
+type nodeLimiter struct {
+	mu      sync.Mutex
+	nodes   map[string]chan struct{}
+	waiting map[string]int
+}
+
+// acquire blocks until a request to the node at url may be sent or ctx is
+// done. The returned function releases the slot.
+func (l *nodeLimiter) acquire(ctx context.Context, url string) (func(), error) {
+	if opts.MaxConcurrencyPerNode <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	if l.nodes == nil {
+		l.nodes = map[string]chan struct{}{}
+	}
+	sem, ok := l.nodes[url]
+	if !ok {
+		sem = make(chan struct{}, opts.MaxConcurrencyPerNode)
+		l.nodes[url] = sem
+	}
+	l.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.waiting == nil {
+		l.waiting = map[string]int{}
+	}
+	l.waiting[url]++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting[url]--
+		l.mu.Unlock()
+	}()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waiters returns the number of requests queued for a slot of the node at
+// url.
+func (l *nodeLimiter) waiters(url string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting[url]
+}
+
+// workerSlots caps the in-flight requests to backends across all client
+// requests if -maxConcurrency is set. The slot is taken after the one of
+// nodeLimits, so requests queued for a saturated node don't use up the slots
+// of the others.
+var workerSlots = &workerPool{}
+
+type workerPool struct {
+	mu  sync.Mutex
+	sem chan struct{}
+}
+
+// acquire blocks until a request may be sent or ctx is done. The returned
+// function releases the slot.
+func (p *workerPool) acquire(ctx context.Context) (func(), error) {
+	if opts.MaxConcurrency <= 0 {
+		return func() {}, nil
+	}
+
+	p.mu.Lock()
+	if p.sem == nil {
+		p.sem = make(chan struct{}, opts.MaxConcurrency)
+	}
+	sem := p.sem
+	p.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
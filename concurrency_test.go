@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyServer records the maximum number of concurrent requests and
+// holds every request until release is closed.
+type concurrencyServer struct {
+	*httptest.Server
+	inFlight, max atomic.Int32
+}
+
+func newConcurrencyServer(t *testing.T, release <-chan struct{}) *concurrencyServer {
+	s := &concurrencyServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		for {
+			m := s.max.Load()
+			if n <= m || s.max.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	return s
+}
+
+func TestGetEndpointData_maxConcurrencyPerNode(t *testing.T) {
+	setOpts(t, func(o *Options) { o.MaxConcurrencyPerNode = 2 })
+	defer func(l *nodeLimiter) { nodeLimits = l }(nodeLimits)
+	nodeLimits = &nodeLimiter{}
+
+	slowRelease := make(chan struct{})
+	slow := newConcurrencyServer(t, slowRelease)
+	defer slow.Close()
+	fastRelease := make(chan struct{})
+	close(fastRelease)
+	fast := newConcurrencyServer(t, fastRelease)
+	defer fast.Close()
+
+	query := func(url string) {
+		var endpoints []Endpoint
+		for i := range 4 {
+			endpoints = append(endpoints, Endpoint{AccountID: fmt.Sprint(i), ProjectID: "p", URL: url})
+		}
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+		if err != nil {
+			t.Errorf("getEndpointData() failed: %v", err)
+		}
+		for _, res := range results {
+			if res.Err != nil {
+				t.Errorf("%s: %v", res.Endpoint, res.Err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query(slow.URL)
+		}()
+	}
+	for slow.inFlight.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the saturated slow node must not starve the fast one
+	done := make(chan struct{})
+	go func() {
+		query(fast.URL)
+		query(fast.URL)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests to the fast node blocked by the slow node")
+	}
+
+	close(slowRelease)
+	wg.Wait()
+
+	if m := slow.max.Load(); m != 2 {
+		t.Errorf("slow node: max %d concurrent requests, want 2", m)
+	}
+	if m := fast.max.Load(); m > 2 {
+		t.Errorf("fast node: max %d concurrent requests, want at most 2", m)
+	}
+}
+
+func TestGetEndpointData_maxConcurrency(t *testing.T) {
+	setOpts(t, func(o *Options) { o.MaxConcurrency = 3 })
+	defer func(p *workerPool) { workerSlots = p }(workerSlots)
+	workerSlots = &workerPool{}
+
+	release := make(chan struct{})
+	var servers []*concurrencyServer
+	for range 2 {
+		s := newConcurrencyServer(t, release)
+		defer s.Close()
+		servers = append(servers, s)
+	}
+	var endpoints []Endpoint
+	for i := range 4 {
+		endpoints = append(endpoints, Endpoint{AccountID: fmt.Sprint(i), ProjectID: "p", URL: servers[i%2].URL})
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+			results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+			if err != nil {
+				t.Errorf("getEndpointData() failed: %v", err)
+			}
+			for _, res := range results {
+				if res.Err != nil {
+					t.Errorf("%s: %v", res.Endpoint, res.Err)
+				}
+			}
+		}()
+	}
+	inFlight := func() int32 { return servers[0].inFlight.Load() + servers[1].inFlight.Load() }
+	for inFlight() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	// give further requests the chance to exceed the cap
+	time.Sleep(50 * time.Millisecond)
+	if n := inFlight(); n != 3 {
+		t.Errorf("%d requests in flight across all client requests, want 3", n)
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestGetEndpointData_maxConcurrencyQueued(t *testing.T) {
+	setOpts(t, func(o *Options) {
+		o.MaxConcurrency = 2
+		o.MaxConcurrencyPerNode = 1
+	})
+	defer func(l *nodeLimiter) { nodeLimits = l }(nodeLimits)
+	nodeLimits = &nodeLimiter{}
+	defer func(p *workerPool) { workerSlots = p }(workerSlots)
+	workerSlots = &workerPool{}
+
+	slowRelease := make(chan struct{})
+	slow := newConcurrencyServer(t, slowRelease)
+	defer slow.Close()
+	fastRelease := make(chan struct{})
+	close(fastRelease)
+	fast := newConcurrencyServer(t, fastRelease)
+	defer fast.Close()
+
+	query := func(url string, accounts int) {
+		var endpoints []Endpoint
+		for i := range accounts {
+			endpoints = append(endpoints, Endpoint{AccountID: fmt.Sprint(i), ProjectID: "p", URL: url})
+		}
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+		if err != nil {
+			t.Errorf("getEndpointData() failed: %v", err)
+		}
+		for _, res := range results {
+			if res.Err != nil {
+				t.Errorf("%s: %v", res.Endpoint, res.Err)
+			}
+		}
+	}
+
+	// one request in flight to the slow node, two more queued for it
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		query(slow.URL, 3)
+	}()
+	for slow.inFlight.Load() < 1 || nodeLimits.waiters(slow.URL) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queued requests must not hold the worker slot left for the fast node
+	done := make(chan struct{})
+	go func() {
+		query(fast.URL, 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(slowRelease)
+		t.Fatal("requests to the fast node blocked by requests queued for the slow node")
+	}
+
+	close(slowRelease)
+	wg.Wait()
+}
+
+func TestWorkerPool_cancel(t *testing.T) {
+	setOpts(t, func(o *Options) { o.MaxConcurrency = 1 })
+	p := &workerPool{}
+
+	release, err := p.acquire(t.Context())
+	if err != nil {
+		t.Fatalf("acquire() failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded while the pool is full, got %v", err)
+	}
+	release()
+	if _, err := p.acquire(t.Context()); err != nil {
+		t.Errorf("acquire() after release failed: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the optional JSON file passed with -config.
+type Config struct {
+	// Routes overrides the compiled-in settings of routes, keyed by path.
+	Routes map[string]RouteConfig `json:"routes"`
+	// Endpoints sets options of storage nodes, keyed by -storageNode URL.
+	Endpoints map[string]EndpointConfig `json:"endpoints"`
+	// Transports defines backend clients by name, used by endpoints that
+	// are reached differently than the rest.
+	Transports map[string]TransportConfig `json:"transports"`
+}
+
+// TransportConfig overrides the backend client flags for the storage nodes
+// using it. Unset fields keep the flag values, an empty proxyURL disables
+// -proxyURL.
+type TransportConfig struct {
+	ProxyURL    *string `json:"proxyURL"`
+	NoProxy     *string `json:"noProxy"`
+	TLSCertFile *string `json:"tlsCertFile"`
+	TLSKeyFile  *string `json:"tlsKeyFile"`
+	TLSCAFile   *string `json:"tlsCAFile"`
+}
+
+// newClient builds the client of the transport on top of the flags in o.
+func (tc TransportConfig) newClient(o Options) (*http.Client, error) {
+	for _, f := range []struct {
+		dst *string
+		src *string
+	}{
+		{&o.ProxyURL, tc.ProxyURL},
+		{&o.NoProxy, tc.NoProxy},
+		{&o.BackendTLSCertFile, tc.TLSCertFile},
+		{&o.BackendTLSKeyFile, tc.TLSKeyFile},
+		{&o.BackendTLSCAFile, tc.TLSCAFile},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	return newHTTPClient(o)
+}
+
+// EndpointConfig holds the options of all endpoints of one storage node.
+type EndpointConfig struct {
+	BodyTemplate string   `json:"bodyTemplate"`
+	Tags         []string `json:"tags"`
+	// Timeout replaces -requestTimeout for the node, e.g. "2m".
+	Timeout string `json:"timeout"`
+	// ExtraFilters and ExtraStreamFilters are added to every query of the
+	// node, see Endpoint.
+	ExtraFilters       string `json:"extraFilters"`
+	ExtraStreamFilters string `json:"extraStreamFilters"`
+	// Transport names the entry of transports the node is queried with
+	// instead of the client configured by flags.
+	Transport string `json:"transport"`
+}
+
+// RouteConfig overrides settings of a single route. Unset fields keep the
+// compiled-in defaults.
+type RouteConfig struct {
+	MergeStrategy *MergeStrategy `json:"mergeStrategy"`
+	Unwrap        *string        `json:"unwrap"`
+	Shard         *bool          `json:"shard"`
+	ArrayMerge    *ArrayMerge    `json:"arrayMerge"`
+	// Resolve maps top-level keys to a scalar resolver, see Resolver.
+	Resolve map[string]Resolver `json:"resolve"`
+	// ContentType is sent instead of the Content-Type of the route format.
+	ContentType *string `json:"contentType"`
+	// Status controls merging of differing "status" fields, see StatusPolicy.
+	Status *StatusPolicy `json:"status"`
+	// Tags restricts the route to endpoints bearing one of them.
+	Tags []string `json:"tags"`
+	// Methods are the allowed HTTP methods, e.g. ["POST"].
+	Methods []string `json:"methods"`
+	// Transforms are names of registered transforms, applied in order.
+	Transforms []string `json:"transforms"`
+	// ForwardPath sends the client request path, including -routePrefix.
+	ForwardPath *bool `json:"forwardPath"`
+	// SortValues orders values[] of merged responses, e.g. "hits:desc".
+	SortValues *ValueSort `json:"sortValues"`
+}
+
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("read config: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// applyRouteOverrides returns a copy of routes with the overrides of cfg
+// applied. Overrides for unknown paths are rejected.
+func applyRouteOverrides(routes []Route, cfg Config) ([]Route, error) {
+	out := make([]Route, len(routes))
+	copy(out, routes)
+
+	for path, rc := range cfg.Routes {
+		found := false
+		for i := range out {
+			if out[i].Path != path {
+				continue
+			}
+			found = true
+			if rc.MergeStrategy != nil {
+				out[i].MergeStrategy = *rc.MergeStrategy
+			}
+			if rc.Unwrap != nil {
+				out[i].Unwrap = *rc.Unwrap
+			}
+			if rc.Shard != nil {
+				out[i].Shard = *rc.Shard
+			}
+			if rc.ArrayMerge != nil {
+				out[i].ArrayMerge = *rc.ArrayMerge
+			}
+			if rc.Resolve != nil {
+				out[i].Resolve = rc.Resolve
+			}
+			if rc.ContentType != nil {
+				out[i].ContentType = *rc.ContentType
+			}
+			if rc.Status != nil {
+				out[i].Status = *rc.Status
+			}
+			if rc.Tags != nil {
+				out[i].Tags = rc.Tags
+			}
+			if rc.Methods != nil {
+				methods := make([]string, len(rc.Methods))
+				for j, m := range rc.Methods {
+					methods[j] = strings.ToUpper(m)
+				}
+				out[i].Methods = methods
+			}
+			if rc.Transforms != nil {
+				for _, name := range rc.Transforms {
+					if _, ok := transforms[name]; !ok {
+						return nil, fmt.Errorf("config: unknown transform %s for route %s", name, path)
+					}
+				}
+				out[i].Transforms = rc.Transforms
+			}
+			if rc.ForwardPath != nil {
+				out[i].ForwardPath = *rc.ForwardPath
+			}
+			if rc.SortValues != nil {
+				out[i].SortValues = *rc.SortValues
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("config: unknown route %s", path)
+		}
+	}
+	return out, nil
+}
+
+// applyEndpointOverrides returns a copy of endpoints with the options of cfg
+// applied to every tenant of the matching storage node. Options for unknown
+// nodes are rejected.
+func applyEndpointOverrides(endpoints []Endpoint, cfg Config) ([]Endpoint, error) {
+	out := make([]Endpoint, len(endpoints))
+	copy(out, endpoints)
+
+	clients := make(map[string]*http.Client, len(cfg.Transports))
+	for name, tc := range cfg.Transports {
+		client, err := tc.newClient(opts)
+		if err != nil {
+			return nil, fmt.Errorf("config: transport %s: %w", name, err)
+		}
+		clients[name] = client
+	}
+
+	for url, ec := range cfg.Endpoints {
+		client, ok := clients[ec.Transport]
+		if ec.Transport != "" && !ok {
+			return nil, fmt.Errorf("config: unknown transport %s for storage node %s", ec.Transport, url)
+		}
+		var timeout time.Duration
+		if ec.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(ec.Timeout); err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("config: invalid timeout %q for storage node %s", ec.Timeout, url)
+			}
+		}
+		found := false
+		for i := range out {
+			if out[i].URL != url {
+				continue
+			}
+			found = true
+			out[i].BodyTemplate = ec.BodyTemplate
+			out[i].Tags = ec.Tags
+			out[i].Timeout = timeout
+			out[i].ExtraFilters = ec.ExtraFilters
+			out[i].ExtraStreamFilters = ec.ExtraStreamFilters
+			out[i].Client = client
+		}
+		if !found {
+			return nil, fmt.Errorf("config: unknown storage node %s", url)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing config failed: %v", err)
+	}
+	return path
+}
+
+func TestApplyRouteOverrides(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/facets": {"mergeStrategy": "sum"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	got, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+
+	var facets Route
+	for _, r := range got {
+		if r.Path == "/select/logsql/facets" {
+			facets = r
+		}
+	}
+	if facets.MergeStrategy != Sum {
+		t.Fatalf("expected overridden strategy sum, got %s", facets.MergeStrategy)
+	}
+	for _, r := range routes {
+		if r.Path == "/select/logsql/facets" && r.MergeStrategy != Merge {
+			t.Errorf("compiled-in routes must not be modified")
+		}
+	}
+
+	var endpoints []Endpoint
+	for range 2 {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, `{"values":[{"value":"A","hits":2}]}`)
+			if err != nil {
+				t.Fatalf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	req := httptest.NewRequest("POST", facets.Path, bytes.NewBuffer([]byte("query=*")))
+	rr := httptest.NewRecorder()
+	makeJSONHandler(facets, endpoints).ServeHTTP(rr, req)
+
+	var gotBody, want any
+	if err := json.Unmarshal(rr.Body.Bytes(), &gotBody); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, rr.Body.String())
+	}
+	if err := json.Unmarshal([]byte(`{"values":[{"value":"A","hits":4}]}`), &want); err != nil {
+		t.Fatalf("json.Unmarshal(want) failed: %v", err)
+	}
+	if !reflect.DeepEqual(gotBody, want) {
+		t.Errorf("got %v, want %v", gotBody, want)
+	}
+}
+
+func TestApplyRouteOverrides_contentType(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/query": {"contentType": "application/json"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	got, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+
+	var query Route
+	for _, r := range got {
+		if r.Path == "/select/logsql/query" {
+			query = r
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"_msg":"a"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+
+	req := httptest.NewRequest("POST", query.Path, bytes.NewBuffer([]byte("query=*")))
+	rr := httptest.NewRecorder()
+	makeJSONHandler(query, endpoints).ServeHTTP(rr, req)
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected overridden Content-Type application/json, got %q", ct)
+	}
+	if rr.Body.String() != `{"_msg":"a"}`+"\n" {
+		t.Errorf("body must stay NDJSON, got %q", rr.Body.String())
+	}
+}
+
+func TestLoadConfig_invalid(t *testing.T) {
+	tests := []string{
+		`{"routes": {"/select/logsql/facets": {"mergeStrategy": "avg"}}}`,
+		`{"routs": {}}`,
+		`not json`,
+	}
+	for _, content := range tests {
+		if _, err := loadConfig(writeConfig(t, content)); err == nil {
+			t.Errorf("expected error for config %s", content)
+		}
+	}
+
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/unknown": {}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	if _, err := applyRouteOverrides(routes, cfg); err == nil {
+		t.Error("expected error for unknown route")
+	}
+}
+
+func TestApplyEndpointOverrides_bodyTemplate(t *testing.T) {
+	var gotBodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed reading body: %v", err)
+		}
+		gotBodies = append(gotBodies, string(body))
+		if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	endpoints, err := parseEndpointsFromFlags("1:p1", server.URL)
+	if err != nil {
+		t.Fatalf("parseEndpointsFromFlags() failed: %v", err)
+	}
+	cfg, err := loadConfig(writeConfig(t, `{"endpoints": {"`+server.URL+`": {"bodyTemplate": "{body}&extra_filters=tenant:{accountID}-{projectID}"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	endpoints, err = applyEndpointOverrides(endpoints, cfg)
+	if err != nil {
+		t.Fatalf("applyEndpointOverrides() failed: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	if _, err := forwardAndMerge(req, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints); err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	if want := []string{"query=*&extra_filters=tenant:1-p1"}; !reflect.DeepEqual(gotBodies, want) {
+		t.Errorf("backend got bodies %q, want %q", gotBodies, want)
+	}
+
+	cfg, err = loadConfig(writeConfig(t, `{"endpoints": {"`+other.URL+`": {"bodyTemplate": "{body}"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	if _, err := applyEndpointOverrides(endpoints, cfg); err == nil {
+		t.Error("expected error for unknown storage node")
+	}
+}
+
+func TestApplyEndpointOverrides_tags(t *testing.T) {
+	endpoints, err := parseEndpointsFromFlags("1:p1,2:p2", "http://node1:9428,http://node2:9428")
+	if err != nil {
+		t.Fatalf("parseEndpointsFromFlags() failed: %v", err)
+	}
+	cfg, err := loadConfig(writeConfig(t, `{
+		"endpoints": {"http://node1:9428": {"tags": ["prod", "eu"]}},
+		"routes": {"/select/logsql/query": {"tags": ["prod"]}}
+	}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	endpoints, err = applyEndpointOverrides(endpoints, cfg)
+	if err != nil {
+		t.Fatalf("applyEndpointOverrides() failed: %v", err)
+	}
+	for _, ep := range endpoints {
+		want := []string(nil)
+		if ep.URL == "http://node1:9428" {
+			want = []string{"prod", "eu"}
+		}
+		if !reflect.DeepEqual(ep.Tags, want) {
+			t.Errorf("%s: tags %v, want %v", ep, ep.Tags, want)
+		}
+	}
+
+	got, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+	for _, r := range got {
+		if r.Path == "/select/logsql/query" && !reflect.DeepEqual(r.Tags, []string{"prod"}) {
+			t.Errorf("route tags %v, want [prod]", r.Tags)
+		}
+	}
+}
+
+func TestApplyEndpointOverrides_timeout(t *testing.T) {
+	setOpts(t, func(o *Options) { o.RequestTimeout = 50 * time.Millisecond })
+
+	var urls []string
+	for range 2 {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(300 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+			if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		urls = append(urls, server.URL)
+	}
+	patient, impatient := urls[0], urls[1]
+
+	endpoints, err := parseEndpointsFromFlags("1:p1", patient+","+impatient)
+	if err != nil {
+		t.Fatalf("parseEndpointsFromFlags() failed: %v", err)
+	}
+	cfg, err := loadConfig(writeConfig(t, `{"endpoints": {"`+patient+`": {"timeout": "5s"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	endpoints, err = applyEndpointOverrides(endpoints, cfg)
+	if err != nil {
+		t.Fatalf("applyEndpointOverrides() failed: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	for _, res := range results {
+		switch res.Endpoint.URL {
+		case patient:
+			if res.Err != nil || string(res.Body) != `{"n":1}`+"\n" {
+				t.Errorf("endpoint with 5s timeout: got %q, %v", res.Body, res.Err)
+			}
+		case impatient:
+			if !errors.Is(res.Err, context.DeadlineExceeded) {
+				t.Errorf("endpoint with the default timeout: expected deadline exceeded, got %v", res.Err)
+			}
+		}
+	}
+
+	for _, timeout := range []string{"soon", "-1s", "0s"} {
+		cfg, err := loadConfig(writeConfig(t, `{"endpoints": {"`+patient+`": {"timeout": "`+timeout+`"}}}`))
+		if err != nil {
+			t.Fatalf("loadConfig() failed: %v", err)
+		}
+		if _, err := applyEndpointOverrides(endpoints, cfg); err == nil {
+			t.Errorf("expected error for timeout %q", timeout)
+		}
+	}
+}
+
+func TestApplyEndpointOverrides_extraFilters(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got = map[string][]string{}
+	)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("failed parsing form: %v", err)
+			}
+			mu.Lock()
+			got[name] = append(r.Form["extra_filters"], r.Form["extra_stream_filters"]...)
+			mu.Unlock()
+			if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+	scoped := newServer("scoped")
+	defer scoped.Close()
+	plain := newServer("plain")
+	defer plain.Close()
+
+	endpoints, err := parseEndpointsFromFlags("1:p1", scoped.URL+","+plain.URL)
+	if err != nil {
+		t.Fatalf("parseEndpointsFromFlags() failed: %v", err)
+	}
+	cfg, err := loadConfig(writeConfig(t, `{"endpoints": {"`+scoped.URL+`": {"extraFilters": "team:=\"a b\"", "extraStreamFilters": "{env=\"prod\"}"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	endpoints, err = applyEndpointOverrides(endpoints, cfg)
+	if err != nil {
+		t.Fatalf("applyEndpointOverrides() failed: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBufferString("query=*&extra_filters=level:error"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := forwardAndMerge(req, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints); err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	want := map[string][]string{
+		"scoped": {"level:error", `team:="a b"`, `{env="prod"}`},
+		"plain":  {"level:error"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("backends got filters %q, want %q", got, want)
+	}
+}
+
+func TestApplyEndpointOverrides_transport(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Host)
+		if _, err := io.WriteString(w, `{"via":"proxy"}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer proxy.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.WriteString(w, `{"via":"direct"}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer direct.Close()
+
+	// the remote node only resolves through the proxy
+	const remote = "http://remote.invalid:9428"
+	endpoints, err := parseEndpointsFromFlags("1:p1", remote+","+direct.URL)
+	if err != nil {
+		t.Fatalf("parseEndpointsFromFlags() failed: %v", err)
+	}
+	cfg, err := loadConfig(writeConfig(t, `{
+		"transports": {"remote": {"proxyURL": "`+proxy.URL+`"}},
+		"endpoints": {"`+remote+`": {"transport": "remote"}}
+	}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	endpoints, err = applyEndpointOverrides(endpoints, cfg)
+	if err != nil {
+		t.Fatalf("applyEndpointOverrides() failed: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBufferString("query=*"))
+	results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	want := map[string]string{remote: `{"via":"proxy"}` + "\n", direct.URL: `{"via":"direct"}` + "\n"}
+	for _, res := range results {
+		if res.Err != nil || string(res.Body) != want[res.Endpoint.URL] {
+			t.Errorf("%s: got %q, %v, want %q", res.Endpoint, res.Body, res.Err, want[res.Endpoint.URL])
+		}
+	}
+	if !reflect.DeepEqual(proxied, []string{"remote.invalid:9428"}) {
+		t.Errorf("proxy got requests for %v, want only the remote node", proxied)
+	}
+
+	for _, config := range []string{
+		`{"endpoints": {"` + remote + `": {"transport": "missing"}}}`,
+		`{"transports": {"remote": {"proxyURL": "::"}}}`,
+	} {
+		cfg, err := loadConfig(writeConfig(t, config))
+		if err != nil {
+			t.Fatalf("loadConfig() failed: %v", err)
+		}
+		if _, err := applyEndpointOverrides(endpoints, cfg); err == nil {
+			t.Errorf("expected error for %s", config)
+		}
+	}
+}
+
+func TestApplyRouteOverrides_methods(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/query": {"methods": ["post"]}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	got, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"n":1}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	mux := http.NewServeMux()
+	for _, route := range got {
+		mux.HandleFunc(route.Path, makeJSONHandler(route, []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}))
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/select/logsql/query", http.StatusMethodNotAllowed},
+		{"POST", "/select/logsql/query", http.StatusOK},
+		{"GET", "/select/logsql/field_names", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path+"?query=*", nil))
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, rr.Code)
+		}
+		if tt.want == http.StatusMethodNotAllowed && rr.Header().Get("Allow") != "POST" {
+			t.Errorf("%s %s: expected Allow: POST, got %q", tt.method, tt.path, rr.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestApplyRouteOverrides_forwardPath(t *testing.T) {
+	setOpts(t, func(o *Options) { o.RoutePrefix = "/logs" })
+	defer func(r []Route) { routes = r }(routes)
+
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/query": {"forwardPath": true}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	if routes, err = applyRouteOverrides(routes, cfg); err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+
+	var gotPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.URL.Path)
+		if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	mux := newMux([]Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}, nil)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/logs/select/logsql/query", "/logs/select/logsql/query"},
+		{"/logs/select/logsql/field_names", "/select/logsql/field_names"},
+	}
+	for _, tt := range tests {
+		gotPaths = nil
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", tt.path, bytes.NewBuffer([]byte("query=*"))))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tt.path, rr.Code)
+		}
+		if len(gotPaths) != 1 || gotPaths[0] != tt.want {
+			t.Errorf("%s: backend got %v, want %s", tt.path, gotPaths, tt.want)
+		}
+	}
+}
+
+func TestMakeJSONHandler_mergeHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.WriteString(w, `{"values":[{"value":"A","hits":2}]}`); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/facets": {"mergeStrategy": "sum"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	configured, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+	byPath := map[string]Route{}
+	for _, r := range configured {
+		byPath[r.Path] = r
+	}
+
+	tests := []struct {
+		header bool
+		path   string
+		query  string
+		want   string
+	}{
+		{false, "/select/logsql/field_names", "", ""},
+		{true, "/select/logsql/field_names", "", "sum"},
+		{true, "/select/logsql/streams", "", "merge"},
+		{true, "/select/logsql/facets", "", "sum"},
+		{true, "/select/logsql/hits", "?_grouped=1", "grouped"},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.MergeHeader = tt.header })
+		rr := httptest.NewRecorder()
+		makeJSONHandler(byPath[tt.path], endpoints).ServeHTTP(rr, httptest.NewRequest("POST", tt.path+tt.query, bytes.NewBuffer([]byte("query=*"))))
+		if got := rr.Header().Get("X-VLMultiselect-Merge"); got != tt.want {
+			t.Errorf("%s%s: got X-VLMultiselect-Merge %q, want %q", tt.path, tt.query, got, tt.want)
+		}
+	}
+}
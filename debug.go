@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// debugResult is the raw response of one endpoint returned for _debug=1.
+type debugResult struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+	Error  string `json:"error,omitempty"`
+}
+
+// wantsDebug reports whether the request asks for the per-endpoint debug
+// output. The _debug parameter is only consumed if -allowDebug is set.
+func wantsDebug(r *http.Request) bool {
+	if !opts.AllowDebug {
+		return false
+	}
+	return slices.Contains(takeQueryParam(r, "_debug"), "1")
+}
+
+// debugResponse forwards the request like forwardAndMerge but returns the
+// unmerged response of every endpoint, keyed by its source label with
+// credentials redacted.
+func debugResponse(r *http.Request, route Route, endpoints []Endpoint) ([]byte, error) {
+	endpoints, err := filterTenants(r, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err = filterTags(r, route.Tags, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	results, err := getEndpointData(r, backendPath(r, route), endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]debugResult, len(results))
+	for _, res := range results {
+		d := debugResult{Status: res.StatusCode, Body: string(res.Body)}
+		if res.Err != nil {
+			d.Error = res.Err.Error()
+		}
+		out[sourceLabel(res.Endpoint)] = d
+	}
+	return json.Marshal(out)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMakeJSONHandler_debug(t *testing.T) {
+	var gotQuery string
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		_, err := io.WriteString(w, `{"values":[{"value":"A","hits":1}]}`)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, err := io.WriteString(w, "node down")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server2.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server1.URL},
+		{AccountID: "2", ProjectID: "p2", URL: strings.Replace(server2.URL, "://", "://user:secret@", 1)},
+	}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/field_names", Format: JSON, MergeStrategy: Sum}, endpoints)
+
+	// without -allowDebug the request is merged as usual and fails
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/field_names?_debug=1", bytes.NewBuffer([]byte("query=*"))))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without -allowDebug, got %d", rr.Code)
+	}
+
+	setOpts(t, func(o *Options) { o.AllowDebug = true })
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/field_names?limit=5&_debug=1", bytes.NewBuffer([]byte("query=*"))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if gotQuery != "limit=5" {
+		t.Errorf("_debug must not be forwarded, got query %q", gotQuery)
+	}
+
+	var got map[string]debugResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, rr.Body.String())
+	}
+	want := map[string]debugResult{
+		sourceLabel(endpoints[0]): {Status: 200, Body: `{"values":[{"value":"A","hits":1}]}`},
+		sourceLabel(endpoints[1]): {Status: 502, Body: "node down", Error: "node down"},
+	}
+	if strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("endpoint credentials must be redacted, got %s", rr.Body.String())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %+v, want %+v", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// dedupLines drops merged NDJSON lines whose -dedupKey fields equal those of
+// an earlier line, e.g. the same log entry returned by two nodes. Field
+// values are compared in compact form, so formatting differences don't
+// matter. Lines that aren't JSON objects or have none of the fields are
+// always kept.
+func dedupLines(b []byte, fields []string) []byte {
+	var out bytes.Buffer
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if key, ok := lineKey(line, fields); ok {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// lineKey returns the compact values of fields in line, separated by NUL
+// bytes. Missing fields are null. ok is false if line is not a JSON object
+// or has none of the fields.
+func lineKey(line []byte, fields []string) (key string, ok bool) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(line, &obj); err != nil || obj == nil {
+		return "", false
+	}
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		raw, found := obj[field]
+		ok = ok || found
+		value, err := valueKey(raw)
+		if err != nil {
+			return "", false
+		}
+		parts[i] = value
+	}
+	return strings.Join(parts, "\x00"), ok
+}
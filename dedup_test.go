@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDedupLines(t *testing.T) {
+	in := `{"_stream_id":"s1","_time":"2024-01-01T00:00:00Z","_msg":"a"}` + "\n" +
+		`{"_stream_id":"s1","_time":"2024-01-01T00:00:01Z","_msg":"b"}` + "\n" +
+		`{ "_time": "2024-01-01T00:00:00Z", "_stream_id": "s1", "_msg": "a, again" }` + "\n" +
+		`{"_stream_id":"s2","_time":"2024-01-01T00:00:00Z","_msg":"c"}` + "\n" +
+		`{"_msg":"no key"}` + "\n" +
+		`{"_msg":"no key"}` + "\n" +
+		`not json` + "\n" +
+		`{"_stream_id":"s2","_msg":"missing time"}` + "\n" +
+		`{"_stream_id":"s2","_time":null,"_msg":"null time"}` + "\n"
+
+	got := dedupLines([]byte(in), []string{"_stream_id", "_time"})
+	want := `{"_stream_id":"s1","_time":"2024-01-01T00:00:00Z","_msg":"a"}` + "\n" +
+		`{"_stream_id":"s1","_time":"2024-01-01T00:00:01Z","_msg":"b"}` + "\n" +
+		`{"_stream_id":"s2","_time":"2024-01-01T00:00:00Z","_msg":"c"}` + "\n" +
+		`{"_msg":"no key"}` + "\n" +
+		`{"_msg":"no key"}` + "\n" +
+		`not json` + "\n" +
+		`{"_stream_id":"s2","_msg":"missing time"}` + "\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestForwardAndMerge_dedupKey(t *testing.T) {
+	setOpts(t, func(o *Options) { o.DedupKey = []string{"_stream_id", "_time"} })
+
+	outputs := []string{
+		`{"_stream_id":"s1","_time":"t1","_msg":"a"}` + "\n" + `{"_stream_id":"s1","_time":"t2","_msg":"b"}` + "\n",
+		`{"_time":"t1","_stream_id":"s1","_msg":"a"}` + "\n" + `{"_stream_id":"s2","_time":"t1","_msg":"c"}` + "\n",
+	}
+	var endpoints []Endpoint
+	for _, out := range outputs {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, out)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	got, err := forwardAndMerge(req, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	want := `{"_stream_id":"s1","_time":"t1","_msg":"a"}` + "\n" +
+		`{"_stream_id":"s1","_time":"t2","_msg":"b"}` + "\n" +
+		`{"_stream_id":"s2","_time":"t1","_msg":"c"}` + "\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
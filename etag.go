@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// etag returns a strong entity tag of the merged response.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// notModified sets the ETag header of body and reports whether the
+// If-None-Match header of r already holds it, in which case the response
+// must be answered with 304.
+func notModified(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	tag := etag(body)
+	w.Header().Set("ETag", tag)
+
+	for candidate := range strings.SplitSeq(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimSpace(candidate)
+		// If-None-Match uses the weak comparison
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
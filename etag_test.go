@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	setOpts(t, func(o *Options) { o.ETag = true })
+
+	body := `{"_msg":"a"}` + "\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, body)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	serve := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := serve("")
+	tag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || tag == "" {
+		t.Fatalf("expected 200 with ETag, got %d and %q", first.Code, tag)
+	}
+	if tag != etag([]byte(body)) {
+		t.Errorf("ETag %s doesn't match the merged body", tag)
+	}
+	if again := serve("").Header().Get("ETag"); again != tag {
+		t.Errorf("ETag of an identical result changed from %s to %s", tag, again)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{tag, http.StatusNotModified},
+		{`"other", ` + tag, http.StatusNotModified},
+		{"W/" + tag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := serve(tt.ifNoneMatch)
+		if rr.Code != tt.want {
+			t.Errorf("If-None-Match %s: expected %d, got %d", tt.ifNoneMatch, tt.want, rr.Code)
+		}
+		if tt.want == http.StatusNotModified && rr.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: 304 must not have a body, got %q", tt.ifNoneMatch, rr.Body.String())
+		}
+		if rr.Header().Get("ETag") != tag {
+			t.Errorf("If-None-Match %s: expected ETag %s, got %q", tt.ifNoneMatch, tag, rr.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestETag_disabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"k":"v"}`)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+
+	req := httptest.NewRequest("POST", "/select/logsql/hits", bytes.NewBuffer([]byte("query=*")))
+	req.Header.Set("If-None-Match", "*")
+	rr := httptest.NewRecorder()
+	makeJSONHandler(Route{Path: "/select/logsql/hits", Format: JSON, MergeStrategy: Merge}, endpoints).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != "" {
+		t.Errorf("expected 200 without ETag, got %d and %q", rr.Code, rr.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// takeQueryParam removes all occurrences of name from the raw query of r and
+// returns their values. The remaining parameters are kept byte for byte and
+// in order, so repeated parameters like extra_filters are never collapsed,
+// as a round trip through url.Values would do.
+func takeQueryParam(r *http.Request, name string) []string {
+	if r.URL.RawQuery == "" {
+		return nil
+	}
+	var (
+		values []string
+		rest   []string
+	)
+	for part := range strings.SplitSeq(r.URL.RawQuery, "&") {
+		key, value, _ := strings.Cut(part, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == name {
+			if v, err := url.QueryUnescape(value); err == nil {
+				values = append(values, v)
+			}
+			continue
+		}
+		rest = append(rest, part)
+	}
+	r.URL.RawQuery = strings.Join(rest, "&")
+	return values
+}
+
+// filterTenants restricts endpoints to the tenants listed in the _tenants
+// query parameter, e.g. _tenants=1:p1,2:p2. The parameter is not forwarded.
+// Tenants that aren't configured are rejected.
+func filterTenants(r *http.Request, endpoints []Endpoint) ([]Endpoint, error) {
+	values := takeQueryParam(r, "_tenants")
+	if len(values) == 0 {
+		return endpoints, nil
+	}
+
+	var wanted []string
+	for _, v := range values {
+		for _, tenant := range splitList(v) {
+			if !slices.ContainsFunc(endpoints, func(ep Endpoint) bool { return ep.AccountID+":"+ep.ProjectID == tenant }) {
+				return nil, fmt.Errorf("unknown tenant %q in _tenants", tenant)
+			}
+			wanted = append(wanted, tenant)
+		}
+	}
+
+	var filtered []Endpoint
+	for _, ep := range endpoints {
+		if slices.Contains(wanted, ep.AccountID+":"+ep.ProjectID) {
+			filtered = append(filtered, ep)
+		}
+	}
+	return filtered, nil
+}
+
+// filterTags restricts endpoints to those bearing one of routeTags, if any,
+// and one of the tags listed in the _tag query parameter, e.g. _tag=prod,eu.
+// The parameter is not forwarded. Tags no endpoint bears are rejected.
+func filterTags(r *http.Request, routeTags []string, endpoints []Endpoint) ([]Endpoint, error) {
+	var requested []string
+	for _, v := range takeQueryParam(r, "_tag") {
+		for _, tag := range splitList(v) {
+			if !slices.ContainsFunc(endpoints, func(ep Endpoint) bool { return slices.Contains(ep.Tags, tag) }) {
+				return nil, fmt.Errorf("unknown tag %q in _tag", tag)
+			}
+			requested = append(requested, tag)
+		}
+	}
+
+	for _, tags := range [][]string{routeTags, requested} {
+		if len(tags) == 0 {
+			continue
+		}
+		var filtered []Endpoint
+		for _, ep := range endpoints {
+			if slices.ContainsFunc(ep.Tags, func(tag string) bool { return slices.Contains(tags, tag) }) {
+				filtered = append(filtered, ep)
+			}
+		}
+		endpoints = filtered
+	}
+	return endpoints, nil
+}
+
+// addDefaultParams appends the -defaultParams the client didn't set, in the
+// query string or in a form-encoded body, to query.
+func addDefaultParams(query string, body []byte, header http.Header) string {
+	if len(opts.DefaultParams) == 0 {
+		return query
+	}
+	set, _ := url.ParseQuery(query)
+	if strings.HasPrefix(header.Get("Content-Type"), "application/x-www-form-urlencoded") && header.Get("Content-Encoding") == "" {
+		form, _ := url.ParseQuery(string(body))
+		for k := range form {
+			set[k] = form[k]
+		}
+	}
+
+	var add []string
+	for _, k := range slices.Sorted(maps.Keys(opts.DefaultParams)) {
+		if _, ok := set[k]; ok {
+			continue
+		}
+		for _, v := range opts.DefaultParams[k] {
+			add = append(add, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	if len(add) == 0 {
+		return query
+	}
+	if query != "" {
+		add = append([]string{query}, add...)
+	}
+	return strings.Join(add, "&")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestMakeJSONHandler_tenantFilter(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queried []string
+		queries []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queried = append(queried, r.Header.Get("AccountID")+":"+r.Header.Get("ProjectID"))
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		_, err := io.WriteString(w, `{"k":"v"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "2", ProjectID: "p2", URL: server.URL},
+		{AccountID: "3", ProjectID: "p3", URL: server.URL},
+	}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	tests := []struct {
+		query       string
+		wantCode    int
+		wantTenants []string
+		wantQuery   string
+	}{
+		{"limit=5&_tenants=1:p1,3:p3", http.StatusOK, []string{"1:p1", "3:p3"}, "limit=5"},
+		{"_tenants=2%3Ap2&limit=5", http.StatusOK, []string{"2:p2"}, "limit=5"},
+		{"limit=5", http.StatusOK, []string{"1:p1", "2:p2", "3:p3"}, "limit=5"},
+		{"_tenants=1:p1,9:p9", http.StatusBadRequest, nil, ""},
+	}
+	for _, tt := range tests {
+		queried, queries = nil, nil
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?"+tt.query, bytes.NewBuffer([]byte("query=*"))))
+
+		if rr.Code != tt.wantCode {
+			t.Errorf("%s: expected %d, got %d", tt.query, tt.wantCode, rr.Code)
+		}
+		slices.Sort(queried)
+		if !slices.Equal(queried, tt.wantTenants) {
+			t.Errorf("%s: queried tenants %v, want %v", tt.query, queried, tt.wantTenants)
+		}
+		for _, q := range queries {
+			if q != tt.wantQuery {
+				t.Errorf("%s: forwarded query %q, want %q", tt.query, q, tt.wantQuery)
+			}
+		}
+	}
+}
+
+func TestMakeJSONHandler_tagFilter(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queried []string
+		queries []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queried = append(queried, r.Header.Get("AccountID")+":"+r.Header.Get("ProjectID"))
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		_, err := io.WriteString(w, `{"k":"v"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL, Tags: []string{"prod", "eu"}},
+		{AccountID: "2", ProjectID: "p2", URL: server.URL, Tags: []string{"prod", "us"}},
+		{AccountID: "3", ProjectID: "p3", URL: server.URL, Tags: []string{"staging"}},
+		{AccountID: "4", ProjectID: "p4", URL: server.URL},
+	}
+
+	tests := []struct {
+		routeTags   []string
+		query       string
+		wantCode    int
+		wantTenants []string
+	}{
+		{nil, "limit=5&_tag=prod", http.StatusOK, []string{"1:p1", "2:p2"}},
+		{nil, "_tag=eu,staging&limit=5", http.StatusOK, []string{"1:p1", "3:p3"}},
+		{nil, "limit=5", http.StatusOK, []string{"1:p1", "2:p2", "3:p3", "4:p4"}},
+		{nil, "_tag=dev", http.StatusBadRequest, nil},
+		{[]string{"prod"}, "limit=5", http.StatusOK, []string{"1:p1", "2:p2"}},
+		{[]string{"prod"}, "limit=5&_tag=us", http.StatusOK, []string{"2:p2"}},
+		{[]string{"prod"}, "_tag=staging", http.StatusServiceUnavailable, nil},
+	}
+	for _, tt := range tests {
+		queried, queries = nil, nil
+		route := Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge, Tags: tt.routeTags}
+		rr := httptest.NewRecorder()
+		makeJSONHandler(route, endpoints).ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?"+tt.query, bytes.NewBuffer([]byte("query=*"))))
+
+		if rr.Code != tt.wantCode {
+			t.Errorf("%v %s: expected %d, got %d", tt.routeTags, tt.query, tt.wantCode, rr.Code)
+		}
+		slices.Sort(queried)
+		if !slices.Equal(queried, tt.wantTenants) {
+			t.Errorf("%v %s: queried tenants %v, want %v", tt.routeTags, tt.query, queried, tt.wantTenants)
+		}
+		for _, q := range queries {
+			if q != "limit=5" {
+				t.Errorf("%v %s: forwarded query %q, want _tag removed", tt.routeTags, tt.query, q)
+			}
+		}
+	}
+}
+
+func TestGetEndpointData_defaultParams(t *testing.T) {
+	var gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	setOpts(t, func(o *Options) {
+		o.DefaultParams = url.Values{"limit": {"1000"}, "_msg_field": {"message"}}
+	})
+
+	tests := []struct {
+		query       string
+		body        string
+		contentType string
+		want        string
+	}{
+		{"", "query=*", "", "_msg_field=message&limit=1000"},
+		{"limit=5", "query=*", "", "limit=5&_msg_field=message"},
+		{"_msg_field=msg&limit=5", "query=*", "", "_msg_field=msg&limit=5"},
+		{"", "query=*&limit=5", "application/x-www-form-urlencoded", "_msg_field=message"},
+		{"", "query=*&limit=5", "text/plain", "_msg_field=message&limit=1000"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/select/logsql/query?"+tt.query, bytes.NewBufferString(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if _, err := getEndpointData(req, "/select/logsql/query", endpoints); err != nil {
+			t.Fatalf("getEndpointData() failed: %v", err)
+		}
+		if gotQuery != tt.want {
+			t.Errorf("query %q, body %q: backend got %q, want %q", tt.query, tt.body, gotQuery, tt.want)
+		}
+	}
+}
+
+func TestMakeJSONHandler_repeatedQueryParams(t *testing.T) {
+	var gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "2", ProjectID: "p2", URL: server.URL},
+	}
+	setOpts(t, func(o *Options) {
+		o.DefaultParams = url.Values{"extra_filters": {"default"}, "extra_stream_filters": {"{app=x}"}}
+	})
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	// all proxy parameters are taken out, the repeated ones keep their order
+	query := "extra_filters=level%3Aerror&_tenants=1:p1&extra_filters=host%3Aa&_source=1&limit=5&extra_filters=app%3Ab&_offset=0&_limit=1"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?"+query, bytes.NewBuffer([]byte("query=*"))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	want := "extra_filters=level%3Aerror&extra_filters=host%3Aa&limit=5&extra_filters=app%3Ab&extra_stream_filters=%7Bapp%3Dx%7D"
+	if gotQuery != want {
+		t.Errorf("backend got query\n%q, want\n%q", gotQuery, want)
+	}
+}
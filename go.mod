@@ -3,3 +3,5 @@ module github.com/ljurk/vlmultiselect
 go 1.24.4
 
 require github.com/qjebbs/go-jsons v0.0.0-20221222033332-a534c5fc1c4c
+
+require golang.org/x/sync v0.19.0
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// wantsGrouped reports whether the request asks for the results grouped per
+// endpoint with _grouped=1. The parameter is never forwarded.
+func wantsGrouped(r *http.Request) bool {
+	return slices.Contains(takeQueryParam(r, "_grouped"), "1")
+}
+
+// groupedResponse forwards the request like forwardAndMerge but returns a
+// JSON object with the parsed result of every endpoint, keyed by endpoint.
+// NDJSON results become an array of their lines. Failed endpoints are
+// handled by the error policy of the route format, with Include they get an
+// {"_error":{...}} value.
+func groupedResponse(r *http.Request, route Route, endpoints []Endpoint) ([]byte, error) {
+	endpoints, err := filterTenants(r, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err = filterTags(r, route.Tags, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	results, err := getEndpointData(r, backendPath(r, route), endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := errorPolicyFor(route.Format)
+	out := make(map[string]json.RawMessage, len(results))
+	for _, res := range results {
+		key := sourceLabel(res.Endpoint)
+		if res.Err == nil {
+			if out[key], err = parseResult(res.Body, route.Format); err != nil {
+				return nil, fmt.Errorf("%s: %w", res.Endpoint, err)
+			}
+			continue
+		}
+
+		switch policy {
+		case Fail:
+			return nil, res.Err
+		case Skip:
+			log.Printf("warning: skipping endpoint %s: %v", res.Endpoint, res.Err)
+		case Include:
+			out[key], err = json.Marshal(map[string]endpointError{"_error": {
+				URL:        redactURL(res.Endpoint.URL),
+				AccountID:  res.Endpoint.AccountID,
+				ProjectID:  res.Endpoint.ProjectID,
+				StatusCode: res.StatusCode,
+				Error:      res.Err.Error(),
+			}})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(out)
+}
+
+// parseResult validates a response body and returns it as a single JSON
+// value.
+func parseResult(b []byte, format Format) (json.RawMessage, error) {
+	if format == JSON {
+		if len(bytes.TrimSpace(b)) == 0 {
+			return json.RawMessage("null"), nil
+		}
+		if !json.Valid(b) {
+			return nil, fmt.Errorf("invalid JSON response")
+		}
+		return b, nil
+	}
+
+	lines := []json.RawMessage{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return nil, fmt.Errorf("invalid NDJSON line %q", line)
+		}
+		lines = append(lines, slices.Clone(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(lines)
+}
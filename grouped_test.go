@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMakeJSONHandler_grouped(t *testing.T) {
+	var gotQuery string
+	newServer := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.RawQuery
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+
+	tests := []struct {
+		route  Route
+		bodies [2]string
+		want   [2]any
+	}{
+		{
+			route:  Route{Path: "/select/logsql/field_names", Format: JSON, MergeStrategy: Sum},
+			bodies: [2]string{`{"values":[{"value":"A","hits":1}]}`, `{"values":[{"value":"A","hits":2}]}`},
+			want: [2]any{
+				map[string]any{"values": []any{map[string]any{"value": "A", "hits": 1.0}}},
+				map[string]any{"values": []any{map[string]any{"value": "A", "hits": 2.0}}},
+			},
+		},
+		{
+			route:  Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge},
+			bodies: [2]string{`{"_msg":"a1"}` + "\n" + `{"_msg":"a2"}` + "\n", `{"_msg":"b1"}`},
+			want: [2]any{
+				[]any{map[string]any{"_msg": "a1"}, map[string]any{"_msg": "a2"}},
+				[]any{map[string]any{"_msg": "b1"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		server1 := newServer(tt.bodies[0])
+		defer server1.Close()
+		server2 := newServer(tt.bodies[1])
+		defer server2.Close()
+		endpoints := []Endpoint{
+			{AccountID: "1", ProjectID: "p1", URL: server1.URL},
+			{AccountID: "2", ProjectID: "p2", URL: server2.URL},
+		}
+
+		rr := httptest.NewRecorder()
+		makeJSONHandler(tt.route, endpoints).ServeHTTP(rr, httptest.NewRequest("POST", tt.route.Path+"?_grouped=1&limit=5", bytes.NewBuffer([]byte("query=*"))))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tt.route.Path, rr.Code, rr.Body.String())
+		}
+		if gotQuery != "limit=5" {
+			t.Errorf("%s: _grouped must not be forwarded, got query %q", tt.route.Path, gotQuery)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected application/json, got %q", tt.route.Path, ct)
+		}
+
+		var got map[string]any
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, rr.Body.String())
+		}
+		want := map[string]any{
+			endpoints[0].String(): tt.want[0],
+			endpoints[1].String(): tt.want[1],
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tt.route.Path, got, want)
+		}
+	}
+}
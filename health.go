@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned for endpoints skipped by an open circuit breaker.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// endpointHealth tracks the request outcomes of all endpoints.
+var endpointHealth = &healthTracker{}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+type endpointState struct {
+	requests            int64
+	errors              int64
+	lastLatency         time.Duration
+	lastError           string
+	consecutiveFailures int
+	breaker             breakerState
+	openedAt            time.Time
+	// window holds the last -failureRateWindow outcomes, true for failures
+	window    []bool
+	windowPos int
+}
+
+// failureRate adds the outcome to the sliding window and returns the share
+// of failures in it. ok is false until the window is full.
+func (s *endpointState) failureRate(failed bool) (rate float64, ok bool) {
+	size := max(opts.FailureRateWindow, 1)
+	if len(s.window) < size {
+		s.window = append(s.window, failed)
+	} else {
+		s.window[s.windowPos%size] = failed
+		s.windowPos++
+	}
+	if len(s.window) < size {
+		return 0, false
+	}
+	n := 0
+	for _, f := range s.window {
+		if f {
+			n++
+		}
+	}
+	return float64(n) / float64(len(s.window)), true
+}
+
+// healthTracker records latency and errors per endpoint and implements a
+// circuit breaker: after -breakerThreshold consecutive failures, or once
+// the failure rate of the last -failureRateWindow requests exceeds
+// -failureRateThreshold, an endpoint is skipped for -breakerCooldown, then a
+// single probe request decides whether it is closed again.
+type healthTracker struct {
+	mu     sync.Mutex
+	states map[string]*endpointState
+}
+
+func (h *healthTracker) state(ep Endpoint) *endpointState {
+	if h.states == nil {
+		h.states = map[string]*endpointState{}
+	}
+	s, ok := h.states[ep.String()]
+	if !ok {
+		s = &endpointState{breaker: breakerClosed}
+		h.states[ep.String()] = s
+	}
+	return s
+}
+
+// allow reports whether a request may be sent to the endpoint.
+func (h *healthTracker) allow(ep Endpoint) bool {
+	if opts.BreakerThreshold <= 0 && opts.FailureRateThreshold <= 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.state(ep)
+	switch s.breaker {
+	case breakerOpen:
+		if time.Since(s.openedAt) < opts.BreakerCooldown {
+			return false
+		}
+		s.breaker = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// a probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// cancelled releases the endpoint after a request the client cancelled,
+// which says nothing about the endpoint and isn't recorded. A half-open
+// breaker opens again with the cooldown already over, so the next request
+// probes the endpoint.
+func (h *healthTracker) cancelled(ep Endpoint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s := h.state(ep); s.breaker == breakerHalfOpen {
+		s.breaker = breakerOpen
+	}
+}
+
+// record stores the outcome of a request. Only transport errors and 5xx
+// responses count as failures for the circuit breaker, a bad query is not
+// the endpoint's fault.
+func (h *healthTracker) record(ep Endpoint, latency time.Duration, res endpointResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.state(ep)
+	s.requests++
+	s.lastLatency = latency
+	if res.Err != nil {
+		s.errors++
+		s.lastError = res.Err.Error()
+	}
+
+	failed := isBackendFailure(res)
+	tripped := false
+	if opts.FailureRateThreshold > 0 && s.breaker != breakerHalfOpen {
+		rate, ok := s.failureRate(failed)
+		tripped = ok && rate > opts.FailureRateThreshold
+	}
+
+	if failed {
+		s.consecutiveFailures++
+		if s.breaker == breakerHalfOpen || (opts.BreakerThreshold > 0 && s.consecutiveFailures >= opts.BreakerThreshold) {
+			tripped = true
+		}
+	} else {
+		s.consecutiveFailures = 0
+		if s.breaker == breakerHalfOpen {
+			// recovered, judge the failure rate from scratch
+			s.window, s.windowPos = nil, 0
+		}
+	}
+
+	if tripped {
+		s.breaker = breakerOpen
+		s.openedAt = time.Now()
+		return
+	}
+	s.breaker = breakerClosed
+}
+
+// isBackendFailure reports whether res failed because of the endpoint, by a
+// transport error or 5xx response, rather than because of a bad query.
+func isBackendFailure(res endpointResult) bool {
+	return res.Err != nil && (res.StatusCode == 0 || res.StatusCode >= 500)
+}
+
+// breaker returns the circuit breaker state of the endpoint.
+func (h *healthTracker) breaker(ep Endpoint) breakerState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state(ep).breaker
+}
+
+// resetBreakers closes all circuit breakers and returns how many were not
+// closed before. Request and error counters are kept.
+func (h *healthTracker) resetBreakers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := 0
+	for _, s := range h.states {
+		if s.breaker != breakerClosed {
+			n++
+		}
+		s.breaker = breakerClosed
+		s.consecutiveFailures = 0
+		s.window, s.windowPos = nil, 0
+	}
+	return n
+}
+
+// endpointStatus is the state of an endpoint as shown on /status.
+type endpointStatus struct {
+	URL         string       `json:"url"`
+	AccountID   string       `json:"accountID"`
+	ProjectID   string       `json:"projectID"`
+	Requests    int64        `json:"requests"`
+	Errors      int64        `json:"errors"`
+	LastLatency string       `json:"lastLatency"`
+	LastError   string       `json:"lastError,omitempty"`
+	Breaker     breakerState `json:"breaker"`
+}
+
+func (h *healthTracker) snapshot(endpoints []Endpoint) []endpointStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statuses := make([]endpointStatus, 0, len(endpoints))
+	for _, ep := range endpoints {
+		s := h.state(ep)
+		statuses = append(statuses, endpointStatus{
+			URL:         redactURL(ep.URL),
+			AccountID:   ep.AccountID,
+			ProjectID:   ep.ProjectID,
+			Requests:    s.requests,
+			Errors:      s.errors,
+			LastLatency: s.lastLatency.String(),
+			LastError:   s.lastError,
+			Breaker:     s.breaker,
+		})
+	}
+	return statuses
+}
+
+// backendHealth is the result of one endpoint on /health.
+type backendHealth struct {
+	URL       string `json:"url"`
+	AccountID string `json:"accountID"`
+	ProjectID string `json:"projectID"`
+	Error     string `json:"error,omitempty"`
+}
+
+// healthHandler answers liveness checks with a static OK. With
+// -healthChecksBackends it queries every endpoint like -startupCheck and
+// returns their status as JSON, with 503 if any of them failed. The checks
+// stop when the client leaves.
+func healthHandler(endpoints []Endpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !opts.HealthChecksBackends {
+			if _, err := io.WriteString(w, "OK"); err != nil {
+				log.Printf("failed to write response: %v", err)
+			}
+			return
+		}
+
+		status := http.StatusOK
+		backends := make([]backendHealth, 0, len(endpoints))
+		for i, err := range checkEndpoints(r.Context(), endpoints) {
+			b := backendHealth{URL: redactURL(endpoints[i].URL), AccountID: endpoints[i].AccountID, ProjectID: endpoints[i].ProjectID}
+			if err != nil {
+				b.Error = err.Error()
+				status = http.StatusServiceUnavailable
+			}
+			backends = append(backends, b)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(map[string][]backendHealth{"endpoints": backends}); err != nil {
+			log.Printf("failed to write response: %v", err)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatusHandler(t *testing.T) {
+	setOpts(t, func(o *Options) {
+		o.BreakerThreshold = 2
+		o.BreakerCooldown = 100 * time.Millisecond
+		o.JSONErrorPolicy = Skip
+	})
+	defer func(h *healthTracker) { endpointHealth = h }(endpointHealth)
+	endpointHealth = &healthTracker{}
+
+	var failing atomic.Bool
+	failing.Store(true)
+	var badHits atomic.Int32
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{}`)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		badHits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, err := io.WriteString(w, `{}`)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer bad.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: good.URL},
+		{AccountID: "2", ProjectID: "p2", URL: bad.URL},
+	}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/streams", Format: JSON, MergeStrategy: Merge}, endpoints)
+	query := func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/select/logsql/streams", bytes.NewBuffer([]byte("query=*"))))
+	}
+	status := func() []endpointStatus {
+		rr := httptest.NewRecorder()
+		statusHandler(endpoints).ServeHTTP(rr, httptest.NewRequest("GET", "/status", nil))
+		var statuses []endpointStatus
+		if err := json.Unmarshal(rr.Body.Bytes(), &statuses); err != nil {
+			t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, rr.Body.String())
+		}
+		return statuses
+	}
+
+	for range 3 {
+		query()
+	}
+	statuses := status()
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 endpoints, got %d", len(statuses))
+	}
+	if s := statuses[0]; s.Requests != 3 || s.Errors != 0 || s.Breaker != breakerClosed || s.AccountID != "1" {
+		t.Errorf("unexpected status for good endpoint: %+v", s)
+	}
+	// the third request is skipped by the open breaker
+	if s := statuses[1]; s.Requests != 2 || s.Errors != 2 || s.Breaker != breakerOpen || s.LastError != "503 Service Unavailable" {
+		t.Errorf("unexpected status for bad endpoint: %+v", s)
+	}
+	if got := badHits.Load(); got != 2 {
+		t.Errorf("expected 2 requests to reach the bad endpoint, got %d", got)
+	}
+
+	failing.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	query()
+	if s := status()[1]; s.Breaker != breakerClosed {
+		t.Errorf("expected breaker to close after successful probe, got %+v", s)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	var failing atomic.Bool
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, err := io.WriteString(w, `{"_msg":"ok"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	handler := healthHandler(endpoints)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "OK" || hits.Load() != 0 {
+		t.Errorf("static mode: got %d %q after %d backend requests", rr.Code, rr.Body.String(), hits.Load())
+	}
+
+	setOpts(t, func(o *Options) { o.HealthChecksBackends = true })
+	for _, tt := range []struct {
+		failing bool
+		code    int
+	}{{false, http.StatusOK}, {true, http.StatusServiceUnavailable}} {
+		failing.Store(tt.failing)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/health", nil))
+		if rr.Code != tt.code {
+			t.Errorf("failing=%v: expected %d, got %d", tt.failing, tt.code, rr.Code)
+		}
+		var got map[string][]backendHealth
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, rr.Body.String())
+		}
+		if len(got["endpoints"]) != 1 || (got["endpoints"][0].Error != "") != tt.failing {
+			t.Errorf("failing=%v: unexpected endpoints %+v", tt.failing, got["endpoints"])
+		}
+	}
+}
+
+func TestHealthHandler_clientCancel(t *testing.T) {
+	setOpts(t, func(o *Options) { o.HealthChecksBackends = true })
+	started := make(chan struct{}, 1)
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client leaving once the body is read
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			t.Errorf("failed reading body: %v", err)
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+	handler := healthHandler([]Endpoint{{AccountID: "1", ProjectID: "p1", URL: hanging.URL}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequestWithContext(ctx, "GET", "/health", nil))
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "context canceled") {
+		t.Errorf("got %d %q, want the check cancelled with the request", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHealthTracker_failureRate(t *testing.T) {
+	setOpts(t, func(o *Options) {
+		o.FailureRateThreshold = 0.5
+		o.FailureRateWindow = 10
+		o.BreakerCooldown = 50 * time.Millisecond
+	})
+	h := &healthTracker{}
+	ep := Endpoint{AccountID: "1", ProjectID: "p1", URL: "http://node1:9428"}
+	ok := endpointResult{Endpoint: ep, StatusCode: http.StatusOK}
+	failed := endpointResult{Endpoint: ep, StatusCode: http.StatusBadGateway, Err: errCircuitOpen}
+	badQuery := endpointResult{Endpoint: ep, StatusCode: http.StatusBadRequest, Err: errCircuitOpen}
+
+	// alternating failures, 50% is not above the threshold
+	for i := range 10 {
+		res := ok
+		if i%2 == 0 {
+			res = failed
+		}
+		h.record(ep, time.Millisecond, res)
+	}
+	if state := h.breaker(ep); state != breakerClosed {
+		t.Fatalf("50%% failures: expected closed, got %s", state)
+	}
+
+	// bad queries are not the endpoint's fault
+	for range 10 {
+		h.record(ep, time.Millisecond, badQuery)
+	}
+	if state := h.breaker(ep); state != breakerClosed {
+		t.Fatalf("bad queries: expected closed, got %s", state)
+	}
+
+	// 5 of the last 10 failed
+	for range 5 {
+		h.record(ep, time.Millisecond, failed)
+	}
+	if state := h.breaker(ep); state != breakerClosed {
+		t.Fatalf("50%% failures: expected closed, got %s", state)
+	}
+	// 6 of the last 10 failed
+	h.record(ep, time.Millisecond, failed)
+	if state := h.breaker(ep); state != breakerOpen {
+		t.Fatalf("60%% failures: expected open, got %s", state)
+	}
+	if h.allow(ep) {
+		t.Fatal("expected disabled endpoint to be skipped")
+	}
+
+	// re-probed after the cooldown, a success closes it with a fresh window
+	time.Sleep(60 * time.Millisecond)
+	if !h.allow(ep) {
+		t.Fatal("expected probe after cooldown")
+	}
+	h.record(ep, time.Millisecond, ok)
+	if state := h.breaker(ep); state != breakerClosed {
+		t.Fatalf("after successful probe: expected closed, got %s", state)
+	}
+	for range 3 {
+		h.record(ep, time.Millisecond, failed)
+	}
+	if state := h.breaker(ep); state != breakerClosed {
+		t.Errorf("recovered endpoint: expected closed, got %s", state)
+	}
+}
@@ -3,14 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/qjebbs/go-jsons"
 )
@@ -20,8 +30,56 @@ type MergeStrategy int
 const (
 	Merge MergeStrategy = iota
 	Sum
+	// Intersect keeps only the values present on every endpoint and sums
+	// their hits.
+	Intersect
+	// Hits sums the time-bucketed series of /select/logsql/hits per
+	// timestamp.
+	Hits
+	// DeepSum unions nested objects and sums numbers with the same path.
+	DeepSum
+	// Table merges tabular {"columns":[...],"rows":[[...]]} responses on the
+	// union of their columns.
+	Table
 )
 
+func (s MergeStrategy) String() string {
+	switch s {
+	case Merge:
+		return "merge"
+	case Sum:
+		return "sum"
+	case Intersect:
+		return "intersect"
+	case Hits:
+		return "hits"
+	case DeepSum:
+		return "deepsum"
+	case Table:
+		return "table"
+	default:
+		return fmt.Sprintf("MergeStrategy(%d)", int(s))
+	}
+}
+
+// associative reports whether merging pairwise in any grouping gives the same
+// result as the sequential fold, so the merge may run as a parallel tree.
+// jsons.Merge and deepSumJSON are not: which conflict of mismatching types
+// or nulls is hit, and which side wins it, depends on the grouping.
+func (s MergeStrategy) associative() bool {
+	return s == Sum
+}
+
+func (s *MergeStrategy) UnmarshalText(text []byte) error {
+	for _, strategy := range []MergeStrategy{Merge, Sum, Intersect, Hits, DeepSum, Table} {
+		if strategy.String() == string(text) {
+			*s = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown merge strategy %q", text)
+}
+
 type Format int
 
 const (
@@ -29,36 +87,309 @@ const (
 	NDJSON
 )
 
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case NDJSON:
+		return "ndjson"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
 type Endpoint struct {
 	AccountID string
 	ProjectID string
 	URL       string
+	// BodyTemplate replaces the forwarded request body if set, see
+	// rewriteBody.
+	BodyTemplate string
+	// Tags select the endpoint with _tag or the tags of a route, e.g. the
+	// environment or region of its storage node.
+	Tags []string
+	// Timeout limits every request to the endpoint instead of
+	// -requestTimeout if set.
+	Timeout time.Duration
+	// ExtraFilters and ExtraStreamFilters are sent as additional
+	// extra_filters and extra_stream_filters, e.g. to scope the data of a
+	// node. VictoriaLogs applies repeated filters together, so client
+	// filters still apply.
+	ExtraFilters       string
+	ExtraStreamFilters string
+	// Client sends the requests to the endpoint instead of the shared
+	// httpClient if set, e.g. for a node behind another proxy.
+	Client *http.Client
+}
+
+// client returns the HTTP client requests to the endpoint are sent with.
+func (e Endpoint) client() *http.Client {
+	if e.Client != nil {
+		return e.Client
+	}
+	return httpClient
+}
+
+func (e Endpoint) String() string {
+	return e.URL + " (" + e.AccountID + ":" + e.ProjectID + ")"
+}
+
+// rewriteBody returns the request body for the endpoint. With a
+// BodyTemplate, {body}, {accountID} and {projectID} in the template are
+// replaced by the client body and the tenant of the endpoint.
+func (e Endpoint) rewriteBody(body []byte) []byte {
+	if e.BodyTemplate == "" {
+		return body
+	}
+	r := strings.NewReplacer("{body}", string(body), "{accountID}", e.AccountID, "{projectID}", e.ProjectID)
+	return []byte(r.Replace(e.BodyTemplate))
+}
+
+// addFilters appends the extra filters of the endpoint to query.
+func (e Endpoint) addFilters(query string) string {
+	for _, f := range []struct{ name, value string }{
+		{"extra_filters", e.ExtraFilters},
+		{"extra_stream_filters", e.ExtraStreamFilters},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if query != "" {
+			query += "&"
+		}
+		query += f.name + "=" + url.QueryEscape(f.value)
+	}
+	return query
+}
+
+// Options holds the runtime settings configured via command-line flags.
+type Options struct {
+	ProxyURL      string
+	NoProxy       string
+	SortEndpoints bool
+
+	JSONErrorPolicy   ErrorPolicy
+	NDJSONErrorPolicy ErrorPolicy
+
+	AdminToken string
+
+	QueryLog        string
+	QueryLogMaxSize int64
+
+	TLSCertFile string
+	TLSKeyFile  string
+
+	BackendTLSCertFile string
+	BackendTLSKeyFile  string
+	BackendTLSCAFile   string
+
+	ConfigFile string
+
+	SampleRate float64
+
+	DedupRequests bool
+
+	WriteTimeout time.Duration
+
+	ForwardHeaders []string
+
+	RoutePrefix string
+
+	MaxMergedBytes int
+
+	DisabledRoutes []string
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	StartupCheck string
+
+	AllowDebug bool
+
+	MetricsEndpointLabel string
+	MetricsHashBuckets   int
+
+	InjectSource bool
+
+	MaxQueryLength int
+	MaxRequestBody int64
+
+	BackendTimeoutHeader bool
+
+	MergeWorkers int
+
+	BackendHTTP2               string
+	BackendMaxIdleConnsPerHost int
+	ConnectTimeout             time.Duration
+
+	DuplicateKeys string
+	ErrorKey      string
+	KeepKeyOrder  bool
+
+	HealthChecksBackends bool
+
+	AdminAllowCIDRs []netip.Prefix
+
+	BackendRetries int
+	RetryBudget    int
+
+	ListenAddr string
+
+	ValidateNDJSON string
+
+	DefaultParams url.Values
+
+	FailureRateThreshold float64
+	FailureRateWindow    int
+
+	Quiet bool
+
+	MaxEndpointsWarn int
+	StrictEndpoints  bool
+
+	MergeHeader bool
+
+	MaxConcurrencyPerNode int
+
+	ETag bool
+
+	BackendScheme string
+
+	NumberFormat string
+
+	DedupKey []string
+
+	MaxConcurrency int
+
+	Debug        bool
+	MergedSample int
+
+	MinMergedRatio float64
+
+	RequestTimeout time.Duration
+	MergeTimeout   time.Duration
+
+	NotFoundAsEmpty bool
+
+	SortByTime string
+
+	SumMissingValue string
+}
+
+var opts = Options{
+	SampleRate:        1,
+	ForwardHeaders:    []string{"User-Agent", "Traceparent", "Tracestate"},
+	BreakerCooldown:   30 * time.Second,
+	MergeWorkers:      1,
+	ListenAddr:        ":8000",
+	FailureRateWindow: 20,
+	MaxEndpointsWarn:  1000,
+	BackendScheme:     "http",
+	MergedSample:      256,
 }
 
 type Route struct {
 	Path          string
 	Format        Format
 	MergeStrategy MergeStrategy
+	// Unwrap is the key of a wrapper object, e.g. "data", whose content is
+	// merged instead of the whole response.
+	Unwrap string
+	// Shard sends each request to a single endpoint chosen by hashing the
+	// query instead of fanning out to all of them.
+	Shard bool
+	// ArrayMerge controls how arrays are combined by the Merge strategy.
+	ArrayMerge ArrayMerge
+	// Resolve picks the merged value of top-level keys of JSON objects with
+	// a field-level resolver instead of the MergeStrategy.
+	Resolve map[string]Resolver
+	// ContentType replaces the Content-Type derived from Format, for clients
+	// that expect a different one.
+	ContentType string
+	// Status controls how JSON responses with differing "status" fields
+	// are merged.
+	Status StatusPolicy
+	// Tags restricts the route to endpoints bearing one of them.
+	Tags []string
+	// Methods are the allowed HTTP methods of client requests, all if empty.
+	Methods []string
+	// Transforms are applied to JSON responses after the merge, see
+	// Transform.
+	Transforms []string
+	// ForwardPath sends the client request path, including -routePrefix,
+	// to the backends instead of Path.
+	ForwardPath bool
+	// SortValues orders values[] of merged JSON responses if set, and can be
+	// changed per request with _sortValues.
+	SortValues ValueSort
+}
+
+// ArrayMerge controls how arrays with the same key are combined.
+type ArrayMerge int
+
+const (
+	// Append concatenates the arrays of all endpoints.
+	Append ArrayMerge = iota
+	// Union keeps every distinct element once, so repeated responses don't
+	// grow the result.
+	Union
+)
+
+func (a *ArrayMerge) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "append":
+		*a = Append
+	case "union":
+		*a = Union
+	default:
+		return fmt.Errorf("unknown array merge %q, use append or union", text)
+	}
+	return nil
+}
+
+// StatusPolicy controls how JSON responses with a top-level "status" field,
+// like {"status":"error",...}, are merged.
+type StatusPolicy int
+
+const (
+	// ErrorWins sets the merged status to the first one in merge order that
+	// isn't "success", so a failed node is never hidden by a successful one.
+	ErrorWins StatusPolicy = iota
+	// FailOnStatus treats responses whose status isn't "success" as failed
+	// endpoints, handled by the error policy of the route format.
+	FailOnStatus
+)
+
+func (p *StatusPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "error":
+		*p = ErrorWins
+	case "fail":
+		*p = FailOnStatus
+	default:
+		return fmt.Errorf("unknown status policy %q, use error or fail", text)
+	}
+	return nil
 }
 
 var routes = []Route{
-	{"/select/logsql/query", NDJSON, Merge},
-	{"/select/logsql/hits", JSON, Merge},
-	{"/select/logsql/field_names", JSON, Sum},
-	{"/select/logsql/field_values", JSON, Sum},
-	{"/select/logsql/facets", JSON, Merge},
-	{"/select/logsql/stats_query", JSON, Merge},
-	{"/select/logsql/stats_query_range", JSON, Merge},
-	{"/select/logsql/stream_ids", JSON, Merge},
-	{"/select/logsql/streams", JSON, Merge},
-	{"/select/logsql/stream_field_names", JSON, Merge},
-	{"/select/logsql/stream_field_values", JSON, Merge},
+	{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge},
+	{Path: "/select/logsql/hits", Format: JSON, MergeStrategy: Hits},
+	{Path: "/select/logsql/field_names", Format: JSON, MergeStrategy: Sum},
+	{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: Sum},
+	{Path: "/select/logsql/facets", Format: JSON, MergeStrategy: Merge},
+	{Path: "/select/logsql/stats_query", Format: JSON, MergeStrategy: Merge},
+	{Path: "/select/logsql/stats_query_range", Format: JSON, MergeStrategy: Merge},
+	{Path: "/select/logsql/stream_ids", Format: JSON, MergeStrategy: Sum},
+	{Path: "/select/logsql/streams", Format: JSON, MergeStrategy: Merge},
+	{Path: "/select/logsql/stream_field_names", Format: JSON, MergeStrategy: Sum},
+	{Path: "/select/logsql/stream_field_values", Format: JSON, MergeStrategy: Sum},
 }
 
 func mergeAndSumJSON(a, b []byte) ([]byte, error) {
 	type Item struct {
-		Hits  int    `json:"hits"`
-		Value string `json:"value"`
+		Hits  json.Number     `json:"hits"`
+		Value json.RawMessage `json:"value"`
 	}
 	type Payload struct {
 		Values []Item `json:"values"`
@@ -72,36 +403,82 @@ func mergeAndSumJSON(a, b []byte) ([]byte, error) {
 		return nil, fmt.Errorf("unmarshal b: %w", err)
 	}
 
-	// Map by Value for easy sum
-	mergedMap := make(map[string]int)
-	for _, item := range pa.Values {
-		mergedMap[item.Value] += item.Hits
-	}
-	for _, item := range pb.Values {
-		mergedMap[item.Value] += item.Hits
+	// Map by the raw Value for easy sum, so "1", 1 and true stay apart.
+	// order keeps the values as first seen, so the result is stable.
+	mergedMap := make(map[string]json.Number)
+	var (
+		order    []string
+		separate []Item
+	)
+	for _, item := range slices.Concat(pa.Values, pb.Values) {
+		key, err := valueKey(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		// a missing value is null, see -sumMissingValue
+		if key == "null" {
+			switch opts.SumMissingValue {
+			case "skip":
+				continue
+			case "separate":
+				separate = append(separate, Item{Hits: addNumbers("0", item.Hits)})
+				continue
+			}
+		}
+		hits, ok := mergedMap[key]
+		if !ok {
+			hits = "0"
+			order = append(order, key)
+		}
+		mergedMap[key] = addNumbers(hits, item.Hits)
 	}
 
 	// Build merged payload
-	merged := Payload{Values: make([]Item, 0, len(mergedMap))}
-	for value, hits := range mergedMap {
-		merged.Values = append(merged.Values, Item{Hits: hits, Value: value})
+	merged := Payload{Values: make([]Item, 0, len(mergedMap)+len(separate))}
+	for _, value := range order {
+		merged.Values = append(merged.Values, Item{Hits: mergedMap[value], Value: json.RawMessage(value)})
 	}
+	merged.Values = append(merged.Values, separate...)
 
 	return json.Marshal(merged)
 }
 
+// valueKey returns the compact form of a raw JSON value, so equal values
+// with different formatting get the same key. A missing value is null.
+func valueKey(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "null", nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return "", fmt.Errorf("invalid value %s: %w", raw, err)
+	}
+	return buf.String(), nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func parseEndpointsFromFlags(ids string, nodes string) ([]Endpoint, error) {
 	var endpoints []Endpoint
 	for storageNode := range strings.SplitSeq(nodes, ",") {
+		storageNode, err := normalizeNodeURL(storageNode)
+		if err != nil {
+			return nil, err
+		}
 		for id := range strings.SplitSeq(ids, ",") {
 			if len(strings.Split(strings.TrimSpace(id), ":")) < 2 {
 				return nil, fmt.Errorf("wrong tenant format, use <tenantID>:<projectID>")
 			}
 
-			if !strings.HasPrefix(storageNode, "http://") {
-				storageNode = "http://" + storageNode
-			}
-
 			endpoints = append(endpoints, Endpoint{
 				AccountID: strings.Split(strings.TrimSpace(id), ":")[0],
 				ProjectID: strings.Split(strings.TrimSpace(id), ":")[1],
@@ -112,12 +489,212 @@ func parseEndpointsFromFlags(ids string, nodes string) ([]Endpoint, error) {
 	return endpoints, nil
 }
 
+// normalizeNodeURL validates a -storageNode entry and returns it as URL
+// without trailing slash. Entries without scheme get -backendScheme.
+func normalizeNodeURL(node string) (string, error) {
+	node = strings.TrimSpace(node)
+	if node == "" {
+		return "", fmt.Errorf("empty storage node")
+	}
+	if !strings.Contains(node, "://") {
+		node = opts.BackendScheme + "://" + node
+	}
+	u, err := url.Parse(node)
+	if err != nil {
+		return "", fmt.Errorf("invalid storage node %q: %w", node, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid storage node %q: scheme must be http or https", node)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid storage node %q: missing host", node)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid storage node %q: query and fragment are not allowed", node)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// checkEndpointCount warns if -storageNode and -tenants multiply to more than
+// -maxEndpointsWarn endpoints, which usually means a flag was filled with the
+// wrong list. With -strictEndpoints it is an error instead.
+func checkEndpointCount(endpoints []Endpoint) error {
+	if opts.MaxEndpointsWarn <= 0 || len(endpoints) <= opts.MaxEndpointsWarn {
+		return nil
+	}
+	nodes := map[string]bool{}
+	for _, ep := range endpoints {
+		nodes[ep.URL] = true
+	}
+	msg := fmt.Sprintf("%d endpoints (%d storage nodes x %d tenants) exceed -maxEndpointsWarn=%d", len(endpoints), len(nodes), len(endpoints)/len(nodes), opts.MaxEndpointsWarn)
+	if opts.StrictEndpoints {
+		return errors.New(msg)
+	}
+	log.Printf("warning: %s", msg)
+	return nil
+}
+
+// sortEndpoints orders endpoints by URL, AccountID and ProjectID. NDJSON
+// results are concatenated in endpoint order, so this makes the output
+// independent of the order of the -storageNode and -tenants flags.
+func sortEndpoints(endpoints []Endpoint) {
+	slices.SortStableFunc(endpoints, compareEndpoints)
+}
+
+func compareEndpoints(a, b Endpoint) int {
+	return cmp.Or(
+		strings.Compare(a.URL, b.URL),
+		strings.Compare(a.AccountID, b.AccountID),
+		strings.Compare(a.ProjectID, b.ProjectID),
+	)
+}
+
 func main() {
 	log.Println("Starting vlmultiselect")
 	var idsFlag string
 	var nodesFlag string
 	flag.StringVar(&nodesFlag, "storageNode", "", "Comma-seperated list of storageNodes")
 	flag.StringVar(&idsFlag, "tenants", "", "Comma-separated list of tenant IDs (e.g., 1,2,3)")
+	flag.StringVar(&opts.ProxyURL, "proxyURL", "", "Proxy URL used for requests to storageNodes")
+	flag.StringVar(&opts.NoProxy, "noProxy", "", "Comma-separated list of hosts, domains or CIDRs that bypass -proxyURL")
+	flag.BoolVar(&opts.SortEndpoints, "sortEndpoints", false, "Sort endpoints by URL and tenant so merged output is stable across restarts")
+	flag.Var(&opts.JSONErrorPolicy, "jsonErrorPolicy", "How failed endpoints are handled on JSON routes: fail, skip or include")
+	flag.Var(&opts.NDJSONErrorPolicy, "ndjsonErrorPolicy", "How failed endpoints are handled on NDJSON routes: fail, skip or include")
+	flag.StringVar(&opts.AdminToken, "adminToken", "", "Bearer token required for the /-/ admin endpoints")
+	flag.StringVar(&opts.QueryLog, "queryLog", "", "File to record all proxied queries to")
+	flag.Int64Var(&opts.QueryLogMaxSize, "queryLogMaxSize", 100<<20, "Size in bytes after which -queryLog is rotated, 0 disables rotation")
+	flag.StringVar(&opts.TLSCertFile, "tlsCertFile", "", "TLS certificate file, enables HTTPS together with -tlsKeyFile")
+	flag.StringVar(&opts.TLSKeyFile, "tlsKeyFile", "", "TLS key file, enables HTTPS together with -tlsCertFile")
+	flag.StringVar(&opts.BackendTLSCertFile, "backendTLSCertFile", "", "Client certificate file for mTLS to storageNodes")
+	flag.StringVar(&opts.BackendTLSKeyFile, "backendTLSKeyFile", "", "Client key file for mTLS to storageNodes")
+	flag.StringVar(&opts.BackendTLSCAFile, "backendTLSCAFile", "", "CA file to verify the certificates of storageNodes")
+	flag.StringVar(&opts.ConfigFile, "config", "", "Path to a JSON config file")
+	flag.Float64Var(&opts.SampleRate, "sampleRate", opts.SampleRate, "Fraction of request bodies to log, between 0 and 1")
+	flag.BoolVar(&opts.DedupRequests, "dedupRequests", false, "Share one fan-out between concurrent identical requests")
+	flag.DurationVar(&opts.WriteTimeout, "writeTimeout", 0, "Maximum time to write a merged response to the client, 0 disables the limit")
+	flag.Func("forwardHeaders", "Comma-separated list of client headers forwarded to storageNodes (default \"User-Agent,Traceparent,Tracestate\")", func(s string) error {
+		opts.ForwardHeaders = splitList(s)
+		return nil
+	})
+	flag.StringVar(&opts.RoutePrefix, "routePrefix", "", "Path prefix all handlers are served below, e.g. /vlmultiselect")
+	flag.IntVar(&opts.MaxMergedBytes, "maxMergedBytes", 0, "Maximum size of merged NDJSON responses in bytes, truncated at a line boundary, 0 disables the limit")
+	flag.Func("disableRoute", "Route path to disable, e.g. /select/logsql/facets (repeatable)", func(s string) error {
+		if !slices.ContainsFunc(routes, func(r Route) bool { return r.Path == s }) {
+			return fmt.Errorf("unknown route %s", s)
+		}
+		opts.DisabledRoutes = append(opts.DisabledRoutes, s)
+		return nil
+	})
+	flag.IntVar(&opts.BreakerThreshold, "breakerThreshold", 0, "Consecutive failures after which an endpoint is skipped, 0 disables the circuit breaker")
+	flag.DurationVar(&opts.BreakerCooldown, "breakerCooldown", opts.BreakerCooldown, "Time an endpoint is skipped before it is probed again")
+	flag.Func("startupCheck", "Query every endpoint before serving: warn logs failures, fail exits on them", func(s string) error {
+		if s != "warn" && s != "fail" {
+			return fmt.Errorf("use warn or fail")
+		}
+		opts.StartupCheck = s
+		return nil
+	})
+	flag.BoolVar(&opts.AllowDebug, "allowDebug", false, "Allow _debug=1 to return the raw response of every endpoint instead of the merge")
+	flag.Func("metricsEndpointLabel", "Endpoint label of backend metrics: url, none or hash:<buckets> (default url)", parseMetricsEndpointLabel)
+	flag.BoolVar(&opts.InjectSource, "injectSource", false, "Add a _source field with the endpoint to every merged NDJSON line, per request with _source=1")
+	flag.IntVar(&opts.MaxQueryLength, "maxQueryLength", 0, "Maximum length of query string plus request body in bytes, longer requests get 413, 0 disables the limit")
+	flag.Int64Var(&opts.MaxRequestBody, "maxRequestBody", 0, "Maximum size of a request body in bytes, larger bodies get 413, 0 disables the limit")
+	flag.BoolVar(&opts.BackendTimeoutHeader, "backendTimeoutHeader", false, "Report the duration of every endpoint in a Server-Timing response header")
+	flag.IntVar(&opts.MergeWorkers, "mergeWorkers", opts.MergeWorkers, "Number of goroutines merging JSON responses pairwise with the sum strategy, 0 uses GOMAXPROCS, 1 merges sequentially")
+	flag.Func("backendHTTP2", "HTTP/2 to storageNodes: tls negotiates it over TLS, h2c also speaks it in plaintext, off uses HTTP/1.1 (default tls)", func(s string) error {
+		if s != "tls" && s != "h2c" && s != "off" {
+			return fmt.Errorf("use tls, h2c or off")
+		}
+		opts.BackendHTTP2 = s
+		return nil
+	})
+	flag.IntVar(&opts.BackendMaxIdleConnsPerHost, "backendMaxIdleConnsPerHost", 0, "Idle keep-alive connections kept per storageNode, 0 uses the Go default of 2")
+	flag.Func("duplicateKeys", "Value kept for duplicate keys within one JSON response: first or last (default last)", func(s string) error {
+		if s != "first" && s != "last" {
+			return fmt.Errorf("use first or last")
+		}
+		opts.DuplicateKeys = s
+		return nil
+	})
+	flag.StringVar(&opts.ErrorKey, "errorKey", "", "Top-level key, e.g. error, that marks a JSON response as failed endpoint even with status 200, handled by -jsonErrorPolicy")
+	flag.BoolVar(&opts.KeepKeyOrder, "keepKeyOrder", false, "Keep the keys of merged JSON objects in the order they were first seen across endpoints instead of sorted")
+	flag.BoolVar(&opts.HealthChecksBackends, "healthChecksBackends", false, "Query every endpoint on /health and return 503 if any fails, instead of a static OK")
+	flag.Func("adminAllowCIDR", "Comma-separated list of CIDRs or IPs allowed to access /metrics, /status, /-/config and /-/reset, empty allows all", func(s string) error {
+		prefixes, err := parseCIDRs(s)
+		if err != nil {
+			return err
+		}
+		opts.AdminAllowCIDRs = append(opts.AdminAllowCIDRs, prefixes...)
+		return nil
+	})
+	flag.IntVar(&opts.BackendRetries, "backendRetries", 0, "Retries per endpoint after transport errors and 5xx responses")
+	flag.IntVar(&opts.RetryBudget, "retryBudget", 0, "Maximum retries across all endpoints of one client request, 0 only limits by -backendRetries")
+	flag.StringVar(&opts.ListenAddr, "listenAddr", opts.ListenAddr, "TCP address to listen on, or unix:/path/to/socket for a Unix domain socket")
+	flag.Func("validateNDJSON", "Check that every NDJSON line from storageNodes is valid JSON: drop removes invalid lines, flag replaces them with {\"_invalid\":\"<line>\"}", func(s string) error {
+		if s != "drop" && s != "flag" {
+			return fmt.Errorf("use drop or flag")
+		}
+		opts.ValidateNDJSON = s
+		return nil
+	})
+	flag.Func("defaultParams", "Query parameters added to every backend request unless the client sets them, e.g. limit=1000", func(s string) error {
+		values, err := url.ParseQuery(s)
+		if err != nil {
+			return err
+		}
+		opts.DefaultParams = values
+		return nil
+	})
+	flag.Float64Var(&opts.FailureRateThreshold, "failureRateThreshold", 0, "Failure rate (0-1) of the last -failureRateWindow requests above which an endpoint is skipped like by -breakerThreshold, 0 disables it")
+	flag.IntVar(&opts.FailureRateWindow, "failureRateWindow", opts.FailureRateWindow, "Number of recent requests per endpoint -failureRateThreshold is computed over")
+	flag.BoolVar(&opts.Quiet, "quiet", false, "Log only the number of configured endpoints at startup instead of each one")
+	flag.IntVar(&opts.MaxEndpointsWarn, "maxEndpointsWarn", opts.MaxEndpointsWarn, "Warn if -storageNode times -tenants results in more endpoints, 0 disables the check")
+	flag.BoolVar(&opts.StrictEndpoints, "strictEndpoints", false, "Exit instead of warning when -maxEndpointsWarn is exceeded")
+	flag.BoolVar(&opts.MergeHeader, "mergeHeader", false, "Report the merge strategy of every response in the X-VLMultiselect-Merge header")
+	flag.IntVar(&opts.MaxConcurrencyPerNode, "maxConcurrencyPerNode", 0, "Maximum in-flight requests per storageNode across all tenants and client requests, 0 disables the limit")
+	flag.BoolVar(&opts.ETag, "etag", false, "Send an ETag of the merged response and answer matching If-None-Match requests with 304")
+	flag.Func("backendScheme", "Scheme of -storageNode entries without one: http or https (default http)", func(s string) error {
+		if s != "http" && s != "https" {
+			return fmt.Errorf("use http or https")
+		}
+		opts.BackendScheme = s
+		return nil
+	})
+	flag.Func("numberFormat", "Format of integers merged by the sum, intersect and deepsum strategies and the sum resolver: int (46) or float (46.0) (default int)", func(s string) error {
+		if s != "int" && s != "float" {
+			return fmt.Errorf("use int or float")
+		}
+		opts.NumberFormat = s
+		return nil
+	})
+	flag.Func("dedupKey", "Comma-separated fields identifying an NDJSON line, e.g. _stream_id,_time; merged lines with the same values are dropped after the first", func(s string) error {
+		opts.DedupKey = splitList(s)
+		return nil
+	})
+	flag.IntVar(&opts.MaxConcurrency, "maxConcurrency", 0, "Maximum in-flight requests to storageNodes across all client requests, 0 disables the limit")
+	flag.BoolVar(&opts.Debug, "debug", false, "Log debug messages, like a sample of every merged response")
+	flag.Float64Var(&opts.MinMergedRatio, "minMergedRatio", 0, "Log a warning if a merged response is smaller than this fraction of the largest endpoint response, e.g. 0.5, to spot merges losing data, 0 disables the check")
+	flag.IntVar(&opts.MergedSample, "mergedSample", opts.MergedSample, "Bytes of every merged response logged with -debug, 0 disables the sample")
+	flag.DurationVar(&opts.ConnectTimeout, "connectTimeout", 0, "Maximum duration of connecting to a storageNode, so unreachable nodes fail fast while slow ones get the -requestTimeout, 0 uses the Go default of 30s")
+	flag.DurationVar(&opts.MergeTimeout, "mergeTimeout", 0, "Maximum duration of merging the responses of a request, slower merges get 500, 0 disables the limit")
+	flag.DurationVar(&opts.RequestTimeout, "requestTimeout", 0, "Maximum duration of every request to a storageNode, overridden per node by timeout in -config, 0 disables the limit")
+	flag.BoolVar(&opts.NotFoundAsEmpty, "notFoundAsEmpty", false, "Treat 404 responses of storageNodes as empty results like 204 instead of failures")
+	flag.Func("sortByTime", "Merge NDJSON responses that are sorted by _time into one sorted response: asc or desc", func(s string) error {
+		if s != "asc" && s != "desc" {
+			return fmt.Errorf("use asc or desc")
+		}
+		opts.SortByTime = s
+		return nil
+	})
+	flag.Func("sumMissingValue", "How the sum strategy handles values[] entries without value or with null: merge sums them into one null entry, skip drops them, separate keeps each one (default merge)", func(s string) error {
+		if s != "merge" && s != "skip" && s != "separate" {
+			return fmt.Errorf("use merge, skip or separate")
+		}
+		opts.SumMissingValue = s
+		return nil
+	})
 	flag.Parse()
 
 	if nodesFlag == "" {
@@ -132,56 +709,599 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
+	if err := checkEndpointCount(endpoints); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
 
-	log.Println("configured endpoints:")
-	for _, i := range endpoints {
-		log.Printf("URL: %s; AccountID: %s; ProjectID: %s\n", i.URL, i.AccountID, i.ProjectID)
+	if opts.ConfigFile != "" {
+		cfg, err := loadConfig(opts.ConfigFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		routes, err = applyRouteOverrides(routes, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		endpoints, err = applyEndpointOverrides(endpoints, cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+
+	if opts.SortEndpoints {
+		sortEndpoints(endpoints)
 	}
 
-	health := func(w http.ResponseWriter, _ *http.Request) {
-		_, err = io.WriteString(w, "OK")
+	if opts.QueryLog != "" {
+		queryLog, err = newQueryLogger(opts.QueryLog, opts.QueryLogMaxSize)
 		if err != nil {
 			log.Fatalf("Error: %v", err)
 		}
 	}
 
-	http.HandleFunc("/health", health)
+	httpClient, err = newHTTPClient(opts)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	logEndpoints(endpoints)
+
+	if opts.StartupCheck != "" {
+		if err := runStartupCheck(opts.StartupCheck, endpoints); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+
+	ln, err := listen(opts.ListenAddr)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	log.Printf("Listening on %s", opts.ListenAddr)
+	srv := &http.Server{Handler: recoverPanics(newMux(endpoints, flag.CommandLine))}
+	shutdown := make(chan struct{})
+	go shutdownOnSignal(srv, shutdown)
+	if err := serve(srv, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdown
+	if queryLog != nil {
+		if err := queryLog.Close(); err != nil {
+			log.Printf("warning: failed to close query log: %v", err)
+		}
+	}
+}
+
+// setMergeHeader reports the merge strategy, or the mode replacing the merge,
+// in X-VLMultiselect-Merge if -mergeHeader is set.
+func setMergeHeader(w http.ResponseWriter, mode string) {
+	if opts.MergeHeader {
+		w.Header().Set("X-VLMultiselect-Merge", mode)
+	}
+}
+
+// logEndpoints logs every configured endpoint, or with -quiet only how many
+// there are.
+func logEndpoints(endpoints []Endpoint) {
+	if opts.Quiet {
+		nodes := map[string]bool{}
+		tenants := map[string]bool{}
+		for _, ep := range endpoints {
+			nodes[ep.URL] = true
+			tenants[ep.AccountID+":"+ep.ProjectID] = true
+		}
+		log.Printf("configured %d endpoints (%d storage nodes, %d tenants)", len(endpoints), len(nodes), len(tenants))
+		return
+	}
+	log.Println("configured endpoints:")
+	for _, i := range endpoints {
+		log.Printf("URL: %s; AccountID: %s; ProjectID: %s\n", i.URL, i.AccountID, i.ProjectID)
+	}
+}
+
+// newMux registers all handlers, below -routePrefix if set.
+func newMux(endpoints []Endpoint, fs *flag.FlagSet) *http.ServeMux {
+	prefix := strings.TrimSuffix(opts.RoutePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"/health", healthHandler(endpoints))
+	mux.HandleFunc(prefix+"/-/config", requireAllowedIP(requireAdmin(configHandler(endpoints, fs))))
+	mux.HandleFunc(prefix+"/status", requireAllowedIP(requireAdmin(statusHandler(endpoints))))
+	mux.HandleFunc(prefix+"/-/reset", requireAllowedIP(requireAdmin(resetHandler)))
+	mux.HandleFunc(prefix+"/-/query/", requireAllowedIP(requireAdmin(queryHandler(endpoints))))
+	mux.HandleFunc(prefix+"/metrics", requireAllowedIP(metricsHandler(endpoints)))
+	mux.HandleFunc(prefix+"/-/version", requireAllowedIP(versionHandler))
 	for _, r := range routes {
 		route := r // create a new variable scoped to this iteration
-		http.HandleFunc(route.Path, makeJSONHandler(route.Path, route.Format, route.MergeStrategy, endpoints))
+		if slices.Contains(opts.DisabledRoutes, route.Path) {
+			log.Printf("route %s disabled", route.Path)
+			continue
+		}
+		// the backend path is the route path, so the prefix is only forwarded
+		// with ForwardPath
+		mux.HandleFunc(prefix+route.Path, makeJSONHandler(route, endpoints))
 	}
-
-	log.Println("Listening on :8000")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	return mux
 }
 
-func makeJSONHandler(path string, format Format, mergeStrategy MergeStrategy, endpoints []Endpoint) http.HandlerFunc {
+func makeJSONHandler(route Route, endpoints []Endpoint) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logRequest(r)
 
-		if format == JSON {
+		if len(route.Methods) > 0 && !slices.Contains(route.Methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(route.Methods, ", "))
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case route.ContentType != "":
+			w.Header().Set("Content-Type", route.ContentType)
+		case route.Format == JSON:
 			w.Header().Set("Content-Type", "application/json")
-		} else {
+		default:
 			w.Header().Set("Content-Type", "application/x-ndjson")
 		}
 
-		data, err := getEndpointData(r, path, endpoints)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if opts.MaxRequestBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, opts.MaxRequestBody)
+		}
+
+		if opts.MaxQueryLength > 0 {
+			body, err := readBody(r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if len(r.URL.RawQuery)+len(body) > opts.MaxQueryLength {
+				http.Error(w, fmt.Sprintf("query exceeds -maxQueryLength of %d bytes", opts.MaxQueryLength), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+
+		if wantsGrouped(r) {
+			setMergeHeader(w, "grouped")
+			w.Header().Set("Content-Type", "application/json")
+			out, err := groupedResponse(r, route, endpoints)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if _, err := w.Write(out); err != nil {
+				log.Printf("failed to write response: %v", err)
+			}
+			return
+		}
+
+		if wantsDebug(r) {
+			setMergeHeader(w, "debug")
+			w.Header().Set("Content-Type", "application/json")
+			out, err := debugResponse(r, route, endpoints)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if _, err := w.Write(out); err != nil {
+				log.Printf("failed to write response: %v", err)
+			}
+			return
+		}
+
+		var (
+			pg     page
+			paging bool
+		)
+		if route.Format == NDJSON {
+			var err error
+			if pg, paging, err = takePage(r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		setMergeHeader(w, route.MergeStrategy.String())
+
+		var timings *endpointTimings
+		if opts.BackendTimeoutHeader {
+			r, timings = withTimings(r)
+		}
+
+		var (
+			merged  []byte
+			streams *sortedStreams
+			err     error
+		)
+		switch {
+		case streamsSorted(route, paging):
+			streams, err = openSortedStreams(r, route, endpoints)
+		case opts.DedupRequests:
+			merged, err = dedupRequest(r, route, endpoints)
+		default:
+			merged, err = forwardAndMerge(r, route, endpoints)
+		}
+		// requests sharing a deduplicated fan-out have no timings of their own
+		if timings != nil {
+			if v := timings.header(); v != "" {
+				w.Header().Set("Server-Timing", v)
+			}
+		}
+		var backendErr *backendError
+		if errors.As(err, &backendErr) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(backendErr.StatusCode)
+			if _, err := w.Write(backendErr.Body); err != nil {
+				log.Printf("failed to write response: %v", err)
+			}
 			return
 		}
-		merged, err := mergeData(data, format, mergeStrategy)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, err)
+			return
+		}
+		if streams != nil {
+			streams.write(w, r)
 			return
 		}
+		if paging {
+			var next int
+			merged, next = pg.apply(merged)
+			if next >= 0 {
+				w.Header().Set("X-VLMultiselect-Next-Offset", strconv.Itoa(next))
+			}
+		}
+		if route.Format == NDJSON && opts.MaxMergedBytes > 0 {
+			var truncated bool
+			merged, truncated = truncateLines(merged, opts.MaxMergedBytes)
+			if truncated {
+				w.Header().Set("X-VLMultiselect-Truncated", "true")
+			}
+		}
+
+		logMergedSample(r, merged)
+
+		if opts.ETag && notModified(w, r, merged) {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		// the deadline starts once the merge is done, so it only limits how
+		// long a slow client can hold on to the merged response
+		if opts.WriteTimeout > 0 {
+			rc := http.NewResponseController(w)
+			if err := rc.SetWriteDeadline(time.Now().Add(opts.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				log.Printf("warning: failed to set write deadline: %v", err)
+			}
+		}
 		if _, err := w.Write(merged); err != nil {
 			log.Printf("failed to write response: %v", err)
 		}
 	}
 }
 
-func getEndpointData(r *http.Request, path string, endpoints []Endpoint) ([][]byte, error) {
+// backendPath returns the path requests of route are sent to.
+func backendPath(r *http.Request, route Route) string {
+	if route.ForwardPath {
+		return r.URL.Path
+	}
+	return route.Path
+}
+
+// errNoEndpoints is returned if no endpoint is left to query, e.g. after
+// all of them were filtered out.
+var errNoEndpoints = errors.New("no endpoints available for this request")
+
+// writeError answers a failed request with 503 if there was no endpoint to
+// query, 413 if the request body exceeded -maxRequestBody, 500 if the merge
+// timed out and 400 otherwise.
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoEndpoints) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errMergeTimeout) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("request body exceeds -maxRequestBody of %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// forwardAndMerge sends the request to all endpoints and merges the results
+// according to the route.
+func forwardAndMerge(r *http.Request, route Route, endpoints []Endpoint) ([]byte, error) {
+	single := len(endpoints) == 1
+	endpoints, err := filterTenants(r, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err = filterTags(r, route.Tags, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	if route.Shard {
+		endpoints, err = shardEndpoint(r, route.Path, endpoints)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	source := route.Format == NDJSON && wantsSource(r)
+	if route.SortValues, err = requestedSort(r, route.SortValues); err != nil {
+		return nil, err
+	}
+
+	results, err := getEndpointData(r, backendPath(r, route), endpoints)
+	if err != nil {
+		return nil, err
+	}
+	if route.Format == NDJSON && opts.ValidateNDJSON != "" {
+		for i, res := range results {
+			if res.Err == nil {
+				results[i].Body = validateLines(res.Body, opts.ValidateNDJSON, res.Endpoint)
+			}
+		}
+	}
+	if source {
+		for i, res := range results {
+			if res.Err == nil {
+				results[i].Body = injectSource(res.Body, sourceLabel(res.Endpoint))
+			}
+		}
+	}
+	if route.Format == JSON && route.Status == FailOnStatus {
+		failOnStatus(results)
+	}
+	if route.Format == JSON && opts.ErrorKey != "" {
+		failOnErrorKey(results, opts.ErrorKey)
+	}
+	// with a single endpoint configured there is nothing to merge, its
+	// response is passed through as it is, status code included
+	if single && len(results) == 1 && passesThrough(route, results[0]) {
+		res := results[0]
+		if res.Err != nil {
+			return nil, &backendError{StatusCode: res.StatusCode, Body: res.Body}
+		}
+		body := res.Body
+		if route.Format == JSON && opts.DuplicateKeys == "first" {
+			if body, err = keepFirstKeys(body); err != nil {
+				return nil, err
+			}
+		}
+		if route.Format == JSON {
+			if body, err = applyTransforms(body, route.Transforms); err != nil {
+				return nil, err
+			}
+			return sortValuesBy(body, route.SortValues)
+		}
+		return body, nil
+	}
+	// JSON objects are always folded in sorted endpoint order, so conflicting
+	// keys resolve the same way whatever the order of the flags. Arrays are
+	// concatenated in endpoint order like NDJSON.
+	if route.Format == JSON && !slices.ContainsFunc(results, func(res endpointResult) bool { return isArrayRooted(res.Body) }) {
+		slices.SortStableFunc(results, func(a, b endpointResult) int {
+			return compareEndpoints(a.Endpoint, b.Endpoint)
+		})
+	}
+	if err := commonQueryError(results); err != nil {
+		return nil, err
+	}
+	data, failed, err := collectResults(results, route.Format)
+	if err != nil {
+		return nil, err
+	}
+	if route.Format == JSON && opts.DuplicateKeys == "first" {
+		for i := range data {
+			if data[i], err = keepFirstKeys(data[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if opts.MergeTimeout <= 0 {
+		return mergeResponses(r.Context(), route, data, failed)
+	}
+	return withMergeTimeout(r.Context(), func(ctx context.Context) ([]byte, error) {
+		return mergeResponses(ctx, route, data, failed)
+	})
+}
+
+// passesThrough reports whether the response of a single endpoint is passed
+// through. Like with several endpoints, an error reported with status 200
+// goes through the error policy and no JSON data, e.g. after a 204, becomes
+// the empty result of the merge strategy.
+func passesThrough(route Route, res endpointResult) bool {
+	switch {
+	case res.StatusCode == 0:
+		return false
+	case res.Err != nil:
+		return res.StatusCode != http.StatusOK
+	case route.Format == JSON:
+		return len(bytes.TrimSpace(res.Body)) > 0
+	}
+	return true
+}
+
+// errMergeTimeout is returned if merging took longer than -mergeTimeout.
+var errMergeTimeout = errors.New("merge timed out")
+
+// withMergeTimeout runs merge and gives up after -mergeTimeout. The merge
+// checks its context between steps, so an abandoned merge stops at the next
+// one and its result is dropped.
+func withMergeTimeout(ctx context.Context, merge func(context.Context) ([]byte, error)) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.MergeTimeout)
+	defer cancel()
+
+	type result struct {
+		merged []byte
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("internal error: %v", p)}
+			}
+		}()
+		merged, err := merge(ctx)
+		done <- result{merged, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.merged, res.err
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w after %v", errMergeTimeout, opts.MergeTimeout)
+	}
+}
+
+// mergeResponses merges the successful responses data of the endpoints and
+// adds the failed ones according to the error policy. It stops with
+// ctx.Err() once ctx is done.
+func mergeResponses(ctx context.Context, route Route, data [][]byte, failed []endpointResult) ([]byte, error) {
+	responses := data
+	var (
+		envelope map[string]json.RawMessage
+		err      error
+	)
+	if route.Unwrap != "" {
+		data, envelope = unwrapJSON(data, route.Unwrap)
+	}
+	var merged []byte
+	if route.Format == NDJSON && opts.SortByTime != "" {
+		merged, err = mergeSortedLines(ctx, data, opts.SortByTime == "desc")
+	} else {
+		merged, err = mergeData(ctx, data, route.Format, route.MergeStrategy)
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkMergedSize(route, merged, data)
+	if route.Format == NDJSON && len(opts.DedupKey) > 0 {
+		merged = dedupLines(merged, opts.DedupKey)
+	}
+	if route.Format == JSON && route.MergeStrategy == Merge && route.ArrayMerge == Union {
+		merged, err = unionArrays(merged)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if route.Format == JSON && len(route.Resolve) > 0 && !isArrayRooted(merged) {
+		merged, err = resolveKeys(merged, data, route.Resolve)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// responses that never had the wrapper don't get it either
+	if envelope != nil {
+		merged, err = rewrapJSON(merged, route.Unwrap, envelope)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, resolved := route.Resolve["status"]; route.Format == JSON && !resolved {
+		merged, err = mergeStatus(merged, responses)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if route.Format == JSON {
+		merged, err = applyTransforms(merged, route.Transforms)
+		if err != nil {
+			return nil, err
+		}
+		// transforms may be expensive, don't finish a merge nobody waits for
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		merged, err = sortValuesBy(merged, route.SortValues)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	merged, err = appendErrors(merged, route.Format, failed)
+	if err != nil {
+		return nil, err
+	}
+	// adding the errors re-encodes the object, order its keys afterwards
+	if route.Format == JSON && opts.KeepKeyOrder {
+		merged, err = orderKeys(merged, responses)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// bodyHeaders are always copied from the client request to every backend
+// request. The body is forwarded as-is, so its encoding has to be kept.
+// Content-Length is set from the buffered body by http.NewRequest.
+var bodyHeaders = []string{"Content-Type", "Content-Encoding"}
+
+// copyHeaders copies the body headers and -forwardHeaders from src to dst.
+func copyHeaders(dst, src http.Header) {
+	for _, headers := range [][]string{bodyHeaders, opts.ForwardHeaders} {
+		for _, h := range headers {
+			if v := src.Get(h); v != "" {
+				dst.Set(h, v)
+			}
+		}
+	}
+}
+
+// endpointResult is the outcome of a request to a single endpoint.
+type endpointResult struct {
+	Endpoint   Endpoint
+	StatusCode int
+	Body       []byte
+	// Stream is the unread body of a successful response if it was
+	// requested with getEndpointStreams, Body is nil then. The caller has
+	// to close it.
+	Stream io.ReadCloser
+	Err    error
+	// Duration is the time until the response was read, or until its
+	// headers arrived for a Stream
+	Duration time.Duration
+}
+
+func getEndpointData(r *http.Request, path string, endpoints []Endpoint) ([]endpointResult, error) {
+	return fetchEndpoints(r, path, endpoints, false)
+}
+
+// getEndpointStreams is getEndpointData, but leaves the body of successful
+// responses unread in Stream, so they can be merged while they arrive.
+func getEndpointStreams(r *http.Request, path string, endpoints []Endpoint) ([]endpointResult, error) {
+	return fetchEndpoints(r, path, endpoints, true)
+}
+
+// closeStreams closes the response streams of results.
+func closeStreams(results []endpointResult) {
+	for _, res := range results {
+		if res.Stream == nil {
+			continue
+		}
+		if err := res.Stream.Close(); err != nil {
+			log.Printf("warning: failed to close response body: %v", err)
+		}
+	}
+}
+
+func fetchEndpoints(r *http.Request, path string, endpoints []Endpoint, stream bool) ([]endpointResult, error) {
+	if len(endpoints) == 0 {
+		return nil, errNoEndpoints
+	}
 	// check if request contains a body
 	query := r.URL.RawQuery
 	body, err := io.ReadAll(r.Body)
@@ -191,104 +1311,273 @@ func getEndpointData(r *http.Request, path string, endpoints []Endpoint) ([][]by
 	if err := r.Body.Close(); err != nil {
 		log.Printf("warning: failed to close request body: %v", err)
 	}
-	if len(body) != 0 {
-		log.Printf("[REQ] body: %s", body)
+	query = addDefaultParams(query, body, r.Header)
+	logBody(body)
+	if queryLog != nil {
+		err := queryLog.Record(queryLogEntry{
+			Time:    time.Now().UTC(),
+			Path:    path,
+			Params:  query,
+			Body:    string(body),
+			Tenants: tenantsOf(endpoints),
+		})
+		if err != nil {
+			log.Printf("warning: failed to write query log: %v", err)
+		}
 	}
 
 	var (
 		wg      sync.WaitGroup
-		mu      sync.Mutex
-		errs    = make([]error, len(endpoints))
-		results = make([][]byte, len(endpoints))
+		results = make([]endpointResult, len(endpoints))
+		budget  = newRetryBudget(opts.RetryBudget)
 	)
 
 	for i, endpoint := range endpoints {
 		wg.Add(1)
 		go func(i int, ep Endpoint) {
 			defer wg.Done()
+			res := &results[i]
+			res.Endpoint = ep
 
-			tempurl := ep.URL + path
-			if query != "" {
-				tempurl += "?" + query
-			}
-
-			req, err := http.NewRequest("POST", tempurl, bytes.NewReader(body))
-			if err != nil {
-				errs[i] = err
-				return
-			}
-			req.Header.Set("AccountID", ep.AccountID)
-			req.Header.Set("ProjectID", ep.ProjectID)
-			if ct := r.Header.Get("Content-Type"); ct != "" {
-				req.Header.Set("Content-Type", ct)
-			}
-
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				errs[i] = err
+			if !endpointHealth.allow(ep) {
+				res.Err = errCircuitOpen
 				return
 			}
+			start := time.Now()
+			defer func() {
+				res.Duration = time.Since(start)
+				// the client left, the endpoint isn't to blame
+				if res.Err != nil && r.Context().Err() != nil {
+					endpointHealth.cancelled(ep)
+					return
+				}
+				endpointHealth.record(ep, res.Duration, *res)
+				backendMetrics.observe(path, ep, res.Duration, res.Err != nil)
+			}()
+			// runs before the deferred record, so a panic counts as failure
 			defer func() {
-				if err = resp.Body.Close(); err != nil {
-					log.Printf("warning: failed to close response body: %v", err)
+				if p := recover(); p != nil {
+					log.Printf("panic querying %s: %v\n%s", ep, p, debug.Stack())
+					res.Err = fmt.Errorf("internal error: %v", p)
 				}
 			}()
 
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				errs[i] = err
-				return
+			tempurl := ep.URL + path
+			if query := ep.addFilters(query); query != "" {
+				tempurl += "?" + query
 			}
-
-			if resp.StatusCode != http.StatusOK {
-				errs[i] = fmt.Errorf("%s", body)
-				return
+			for attempt := 1; ; attempt++ {
+				*res = endpointResult{Endpoint: ep}
+				queryEndpoint(r, tempurl, ep.rewriteBody(body), res, stream)
+				if !isBackendFailure(*res) || r.Context().Err() != nil || attempt > opts.BackendRetries || !budget.take() {
+					return
+				}
+				log.Printf("warning: retrying %s after attempt %d: %v", ep, attempt, res.Err)
 			}
-
-			mu.Lock()
-			results[i] = body
-			mu.Unlock()
 		}(i, endpoint)
 	}
 	wg.Wait()
+	recordTimings(r.Context(), results)
 
-	for _, e := range errs {
-		if e != nil {
-			return nil, e
+	return results, nil
+}
+
+var utf8BOM = []byte("\ufeff")
+
+// queryEndpoint sends the request to a single endpoint and stores the
+// response in res. A response other than 200 is an error with the body, or
+// the status if the body is empty, as message. With stream, the body of a
+// 200 response is left unread in res.Stream.
+func queryEndpoint(r *http.Request, url string, body []byte, res *endpointResult, stream bool) {
+	ep := res.Endpoint
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if timeout := cmp.Or(ep.Timeout, opts.RequestTimeout); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	// a streamed body outlives this call, closing it cleans up instead
+	cleanup := func() { cancel() }
+	defer func() {
+		if res.Stream == nil {
+			cleanup()
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		res.Err = err
+		return
+	}
+	req.Header.Set("AccountID", ep.AccountID)
+	req.Header.Set("ProjectID", ep.ProjectID)
+	copyHeaders(req.Header, r.Header)
+	// the node may reject the body before it is sent, the client got its
+	// 100 Continue when the body was read
+	if len(body) > 0 && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		req.Header.Set("Expect", "100-continue")
+	}
+
+	// the node slot comes first, a request waiting for a saturated node
+	// must not hold a worker slot the other nodes could use
+	releaseNode, err := nodeLimits.acquire(r.Context(), ep.URL)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	releaseWorker, err := workerSlots.acquire(r.Context())
+	if err != nil {
+		releaseNode()
+		res.Err = err
+		return
+	}
+	cleanup = func() {
+		releaseWorker()
+		releaseNode()
+		cancel()
+	}
+
+	resp, err := ep.client().Do(req)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	if stream && resp.StatusCode == http.StatusOK {
+		res.StatusCode = resp.StatusCode
+		res.Stream = newStreamBody(resp.Body, cleanup)
+		return
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.Printf("warning: failed to close response body: %v", err)
+		}
+	}()
+
+	res.StatusCode = resp.StatusCode
+	res.Body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	// a BOM would end up in the first merged line or break JSON parsing
+	res.Body = bytes.TrimPrefix(res.Body, utf8BOM)
+
+	// no matching data, nothing to merge
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound && opts.NotFoundAsEmpty {
+		res.Body = nil
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if len(bytes.TrimSpace(res.Body)) == 0 {
+			res.Err = errors.New(resp.Status)
+		} else {
+			res.Err = fmt.Errorf("%s", res.Body)
 		}
 	}
-	return results, nil
 }
 
-func mergeData(data [][]byte, format Format, mergeStrategy MergeStrategy) ([]byte, error) {
+// streamBody is a response body handed to the caller of queryEndpoint.
+type streamBody struct {
+	*bufio.Reader
+	body    io.Closer
+	release func()
+}
+
+// newStreamBody wraps body, closing it calls release. A leading BOM is
+// skipped like for read bodies.
+func newStreamBody(body io.ReadCloser, release func()) *streamBody {
+	b := &streamBody{Reader: bufio.NewReader(body), body: body, release: release}
+	if p, _ := b.Peek(len(utf8BOM)); bytes.Equal(p, utf8BOM) {
+		_, _ = b.Discard(len(utf8BOM))
+	}
+	return b
+}
+
+func (b *streamBody) Close() error {
+	err := b.body.Close()
+	b.release()
+	return err
+}
+
+func mergeData(ctx context.Context, data [][]byte, format Format, mergeStrategy MergeStrategy) ([]byte, error) {
 	switch format {
 	case JSON:
-		merged := []byte(`{}`)
-		for _, b := range data {
-			var err error
-			switch mergeStrategy {
-			case Merge:
-				merged, err = jsons.Merge(merged, b)
-			case Sum:
-				merged, err = mergeAndSumJSON(merged, b)
-			default:
-				log.Fatalf("unknown MergeStrategy: %d", mergeStrategy)
-			}
+		if slices.ContainsFunc(data, isArrayRooted) {
+			return concatJSONArrays(data)
+		}
+		if mergeStrategy == Intersect {
+			return intersectValues(data)
+		}
+		if mergeStrategy == Hits {
+			return mergeHits(data)
+		}
+		if mergeStrategy == Table {
+			return mergeTables(data)
+		}
 
-			if err != nil {
+		var merge func(a, b []byte) ([]byte, error)
+		switch mergeStrategy {
+		case Merge:
+			merge = func(a, b []byte) ([]byte, error) { return jsons.Merge(a, b) }
+		case Sum:
+			merge = mergeAndSumJSON
+		case DeepSum:
+			merge = deepSumJSON
+		default:
+			log.Fatalf("unknown MergeStrategy: %d", mergeStrategy)
+		}
+
+		// the fold starts from an empty result so a single response is
+		// normalized too
+		data = append([][]byte{mergeSeed(mergeStrategy)}, data...)
+		if workers := mergeWorkers(); workers > 1 && mergeStrategy.associative() {
+			return reduceParallel(ctx, data, merge, workers)
+		}
+		merged := data[0]
+		for _, b := range data[1:] {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			var err error
+			if merged, err = merge(merged, b); err != nil {
 				return nil, fmt.Errorf("json merge failed: %w", err)
 			}
 		}
+		if mergeStrategy == DeepSum {
+			return formatNumbers(merged)
+		}
 		return merged, nil
 
 	case NDJSON:
 		var merged bytes.Buffer
 		for _, b := range data {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			// a JSON array instead of NDJSON contributes one line per element
+			if isArrayRooted(b) {
+				var items []json.RawMessage
+				if err := json.Unmarshal(b, &items); err != nil {
+					return nil, fmt.Errorf("ndjson merge failed: unmarshal array: %w", err)
+				}
+				for _, item := range items {
+					if err := json.Compact(&merged, item); err != nil {
+						return nil, fmt.Errorf("ndjson merge failed: %w", err)
+					}
+					merged.WriteByte('\n')
+				}
+				continue
+			}
+
+			// every line is terminated with '\n', so the last line of one
+			// endpoint is never fused with the first line of the next
 			scanner := bufio.NewScanner(bytes.NewReader(b))
+			scanner.Buffer(nil, len(b)+1)
 			for scanner.Scan() {
 				merged.Write(scanner.Bytes())
 				merged.WriteByte('\n')
 			}
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("ndjson merge failed: %w", err)
+			}
 		}
 		return merged.Bytes(), nil
 
@@ -297,6 +1586,74 @@ func mergeData(data [][]byte, format Format, mergeStrategy MergeStrategy) ([]byt
 	}
 }
 
+// mergeSeed returns the empty result a JSON fold starts from, in the shape
+// the strategy produces, so it adds nothing to the first real result.
+func mergeSeed(strategy MergeStrategy) []byte {
+	if strategy == Sum {
+		return []byte(`{"values":[]}`)
+	}
+	return []byte(`{}`)
+}
+
+// truncateLines cuts NDJSON to at most limit bytes, keeping whole lines only.
+func truncateLines(b []byte, limit int) ([]byte, bool) {
+	if len(b) <= limit {
+		return b, false
+	}
+	return b[:bytes.LastIndexByte(b[:limit], '\n')+1], true
+}
+
 func logRequest(r *http.Request) {
 	log.Printf("[REQ] %s %s?%s", r.Method, r.URL.Path, r.URL.RawQuery)
 }
+
+// logMergedSample logs the first -mergedSample bytes of a merged response
+// with -debug, to check merges without logging whole responses.
+func logMergedSample(r *http.Request, merged []byte) {
+	if !opts.Debug || opts.MergedSample <= 0 {
+		return
+	}
+	sample := merged
+	if len(sample) > opts.MergedSample {
+		sample = sample[:opts.MergedSample]
+	}
+	log.Printf("[DEBUG] %s merged %d bytes: %q", r.URL.Path, len(merged), sample)
+}
+
+// checkMergedSize logs a warning if merged is smaller than -minMergedRatio
+// of the largest response it was merged from. Merging never shrinks the data
+// below a single response unless values are dropped, e.g. by a merge bug or
+// the intersect strategy.
+func checkMergedSize(route Route, merged []byte, data [][]byte) {
+	if opts.MinMergedRatio <= 0 {
+		return
+	}
+	largest := 0
+	for _, b := range data {
+		largest = max(largest, len(b))
+	}
+	if float64(len(merged)) < opts.MinMergedRatio*float64(largest) {
+		log.Printf("warning: merged response of %s is %d bytes, the largest endpoint response %d bytes", route.Path, len(merged), largest)
+	}
+}
+
+var (
+	sampleMu   sync.Mutex
+	sampleRand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+)
+
+// logBody logs a non-empty request body with probability -sampleRate.
+func logBody(body []byte) {
+	if len(body) == 0 || opts.SampleRate <= 0 {
+		return
+	}
+	if opts.SampleRate < 1 {
+		sampleMu.Lock()
+		skip := sampleRand.Float64() >= opts.SampleRate
+		sampleMu.Unlock()
+		if skip {
+			return
+		}
+	}
+	log.Printf("[REQ] body: %s", body)
+}
@@ -2,15 +2,27 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // ensure deterministic order of values[]**
@@ -42,8 +54,16 @@ func TestParseEndpointsFromFlags(t *testing.T) {
 	}{
 		{"1:projA,2:projB", "node1.com,node2.com", false, 4},
 		{"1:projA", "http://node1.com", false, 1},
+		{"1:projA", "https://node1.com", false, 1},
 		{"1projA", "node1.com", true, 0},
 		{"", "", true, 0},
+		{"1:projA", "node1.com:9428,", true, 0},
+		{"1:projA", "node1.com:port", true, 0},
+		{"1:projA", "ftp://node1.com", true, 0},
+		{"1:projA", "http://", true, 0},
+		{"1:projA", "http://node1.com?x=1", true, 0},
+		{"1:projA", "http://[::1", true, 0},
+		{"1:projA", " node1.com:9428/ , https://node2.com/vl/", false, 2},
 	}
 
 	for _, tt := range tests {
@@ -55,6 +75,65 @@ func TestParseEndpointsFromFlags(t *testing.T) {
 		if len(got) != tt.wantLen {
 			t.Errorf("expected %d endpoints, got %d", tt.wantLen, len(got))
 		}
+		for _, ep := range got {
+			if strings.Count(ep.URL, "://") != 1 || strings.HasSuffix(ep.URL, "/") || strings.Contains(ep.URL, " ") {
+				t.Errorf("malformed endpoint URL %q", ep.URL)
+			}
+		}
+	}
+}
+
+func TestParseEndpointsFromFlags_backendScheme(t *testing.T) {
+	tests := []struct {
+		scheme string
+		node   string
+		want   string
+	}{
+		{"http", "node1.com:9428", "http://node1.com:9428"},
+		{"http", "https://node1.com:9428", "https://node1.com:9428"},
+		{"https", "node1.com:9428", "https://node1.com:9428"},
+		{"https", "http://node1.com:9428", "http://node1.com:9428"},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.BackendScheme = tt.scheme })
+		got, err := parseEndpointsFromFlags("1:projA", tt.node)
+		if err != nil {
+			t.Fatalf("-backendScheme=%s %s: unexpected error: %v", tt.scheme, tt.node, err)
+		}
+		if got[0].URL != tt.want {
+			t.Errorf("-backendScheme=%s %s: got %s, want %s", tt.scheme, tt.node, got[0].URL, tt.want)
+		}
+	}
+}
+
+func TestMakeJSONHandler_noEndpoints(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected backend request")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		comment   string
+		route     Route
+		target    string
+		endpoints []Endpoint
+	}{
+		{"json without endpoints", Route{Path: "/select/logsql/hits", Format: JSON, MergeStrategy: Merge}, "/select/logsql/hits", nil},
+		{"ndjson without endpoints", Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, "/select/logsql/query", nil},
+		{"all tenants filtered", Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, "/select/logsql/query?_tenants=",
+			[]Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}},
+		{"grouped", Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, "/select/logsql/query?_grouped=1", nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.target, bytes.NewBuffer([]byte("query=*")))
+		rr := httptest.NewRecorder()
+		makeJSONHandler(tt.route, tt.endpoints).ServeHTTP(rr, req)
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected 503, got %d", tt.comment, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), "no endpoints available") {
+			t.Errorf("%s: unexpected body %q", tt.comment, rr.Body.String())
+		}
 	}
 }
 
@@ -147,13 +226,18 @@ func TestForwardAndMerge_json(t *testing.T) {
 		req := httptest.NewRequest("POST", fmt.Sprintf("%s?filter=ok", tt.path), bytes.NewBuffer([]byte("test payload")))
 		req.Header.Set("Content-Type", "application/json")
 
-		data, err := getEndpointData(req, tt.path, endpoints)
+		results, err := getEndpointData(req, tt.path, endpoints)
 
 		if err != nil {
 			t.Fatalf("getEndpointData() failed: %s", err)
 			return
 		}
-		got, err := mergeData(data, JSON, tt.strat)
+		data, _, err := collectResults(results, JSON)
+		if err != nil {
+			t.Fatalf("collectResults() failed: %s", err)
+			return
+		}
+		got, err := mergeData(context.Background(), data, JSON, tt.strat)
 		if (err != nil) == tt.wantErr {
 			continue
 		}
@@ -199,12 +283,17 @@ func TestForwardAndMerge_ndjson(t *testing.T) {
 	req := httptest.NewRequest("POST", "/select/logsql/query?filter=ok", bytes.NewBuffer([]byte("test payload")))
 	req.Header.Set("Content-Type", "application/json")
 
-	data, err := getEndpointData(req, "/select/logsql/query", endpoints)
+	results, err := getEndpointData(req, "/select/logsql/query", endpoints)
 	if err != nil {
 		t.Fatalf("getEndpointData() failed: %s", err)
 		return
 	}
-	got, err := mergeData(data, NDJSON, Merge)
+	data, _, err := collectResults(results, NDJSON)
+	if err != nil {
+		t.Fatalf("collectResults() failed: %s", err)
+		return
+	}
+	got, err := mergeData(context.Background(), data, NDJSON, Merge)
 	if err != nil {
 		t.Fatalf("mergeData() failed: %s", err)
 		return
@@ -232,7 +321,7 @@ func TestMakeJSONHandler_NDJSON(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := makeJSONHandler("/select/logsql/query", NDJSON, Merge, endpoints)
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusOK {
@@ -243,3 +332,1003 @@ func TestMakeJSONHandler_NDJSON(t *testing.T) {
 		t.Errorf("expected NDJSON body, got %s", rr.Body.String())
 	}
 }
+
+// Merged NDJSON must follow the configured endpoint order, regardless of
+// which backend answers first.
+func TestForwardAndMerge_ndjsonEndpointOrder(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		_, err := io.WriteString(w, `{"node":"slow"}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"node":"fast"}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer fast.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: slow.URL},
+		{AccountID: "2", ProjectID: "p2", URL: fast.URL},
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %s", err)
+	}
+	data, _, err := collectResults(results, NDJSON)
+	if err != nil {
+		t.Fatalf("collectResults() failed: %s", err)
+	}
+	got, err := mergeData(context.Background(), data, NDJSON, Merge)
+	if err != nil {
+		t.Fatalf("mergeData() failed: %s", err)
+	}
+
+	want := `{"node":"slow"}` + "\n" + `{"node":"fast"}` + "\n"
+	if string(got) != want {
+		t.Errorf("merged NDJSON not in endpoint order:\n  got:  %q\n  want: %q", got, want)
+	}
+}
+
+func TestSortEndpoints(t *testing.T) {
+	endpoints := []Endpoint{
+		{AccountID: "2", ProjectID: "p", URL: "http://b"},
+		{AccountID: "1", ProjectID: "p", URL: "http://b"},
+		{AccountID: "2", ProjectID: "p", URL: "http://a"},
+	}
+	sortEndpoints(endpoints)
+
+	want := []Endpoint{
+		{AccountID: "2", ProjectID: "p", URL: "http://a"},
+		{AccountID: "1", ProjectID: "p", URL: "http://b"},
+		{AccountID: "2", ProjectID: "p", URL: "http://b"},
+	}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("sortEndpoints() = %v, want %v", endpoints, want)
+	}
+}
+
+// setOpts overrides the global options for the duration of a test.
+func setOpts(t *testing.T, fn func(o *Options)) {
+	t.Helper()
+	saved := opts
+	t.Cleanup(func() { opts = saved })
+	fn(&opts)
+}
+
+func TestForwardAndMerge_gzipBody(t *testing.T) {
+	var gotEncoding, gotBody string
+	var gotLength int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		gotLength = r.ContentLength
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("backend failed to read gzip body: %v", err)
+			return
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Errorf("backend failed to decompress body: %v", err)
+			return
+		}
+		gotBody = string(b)
+		_, err = io.WriteString(w, `{"k":"v"}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := io.WriteString(zw, "query=*&limit=5"); err != nil {
+		t.Fatalf("gzip write failed: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip close failed: %v", err)
+	}
+	size := int64(compressed.Len())
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", &compressed)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %s", err)
+	}
+	if results[0].Err != nil {
+		t.Fatalf("backend request failed: %s", results[0].Err)
+	}
+
+	if gotEncoding != "gzip" {
+		t.Errorf("expected Content-Encoding gzip, got %q", gotEncoding)
+	}
+	if gotLength != size {
+		t.Errorf("expected Content-Length %d, got %d", size, gotLength)
+	}
+	if gotBody != "query=*&limit=5" {
+		t.Errorf("unexpected decompressed body %q", gotBody)
+	}
+}
+
+// stream_field_names and stream_field_values must union their values across
+// nodes, summing the hits of entries present on several nodes.
+func TestRoutes_streamFieldsUnion(t *testing.T) {
+	outputs := []string{
+		`{"values":[{"value":"host","hits":3},{"value":"app","hits":1}]}`,
+		`{"values":[{"value":"host","hits":2},{"value":"env","hits":4}]}`,
+	}
+	var endpoints []Endpoint
+	for _, out := range outputs {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, out)
+			if err != nil {
+				t.Fatalf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	for _, path := range []string{"/select/logsql/stream_field_names", "/select/logsql/stream_field_values"} {
+		idx := slices.IndexFunc(routes, func(r Route) bool { return r.Path == path })
+		if idx < 0 {
+			t.Fatalf("route %s not registered", path)
+		}
+		route := routes[idx]
+
+		req := httptest.NewRequest("POST", path, bytes.NewBuffer([]byte("query=*")))
+		rr := httptest.NewRecorder()
+		makeJSONHandler(route, endpoints).ServeHTTP(rr, req)
+
+		var got, want any
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("json.Unmarshal(got) failed: %v\nraw: %s", err, rr.Body.String())
+		}
+		if err := json.Unmarshal([]byte(`{"values":[{"value":"app","hits":1},{"value":"env","hits":4},{"value":"host","hits":5}]}`), &want); err != nil {
+			t.Fatalf("json.Unmarshal(want) failed: %v", err)
+		}
+		normalize(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestMergeData_ndjsonWithoutTrailingNewline(t *testing.T) {
+	long := `{"msg":"` + strings.Repeat("x", 100*1024) + `"}`
+	data := [][]byte{
+		[]byte(`{"a":1}` + "\n" + `{"a":2}`),
+		[]byte(`{"b":1}`),
+		[]byte(long),
+	}
+
+	got, err := mergeData(context.Background(), data, NDJSON, Merge)
+	if err != nil {
+		t.Fatalf("mergeData() failed: %s", err)
+	}
+
+	want := []string{`{"a":1}`, `{"a":2}`, `{"b":1}`, long}
+	lines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines fused or lost: got %d lines, want %d", len(lines), len(want))
+	}
+}
+
+func TestForwardAndMerge_minMergedRatio(t *testing.T) {
+	newServer := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+	a := newServer(`{"values":[{"value":"A","hits":1},{"value":"B","hits":2},{"value":"C","hits":3}]}`)
+	defer a.Close()
+	b := newServer(`{"values":[{"value":"D","hits":4}]}`)
+	defer b.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: a.URL}, {AccountID: "2", ProjectID: "p2", URL: b.URL}}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		ratio    float64
+		strategy MergeStrategy
+		warn     bool
+	}{
+		{0.5, Sum, false},
+		// no value is on both nodes, so the intersection drops everything
+		{0.5, Intersect, true},
+		{0, Intersect, false},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.MinMergedRatio = tt.ratio })
+		buf.Reset()
+		req := httptest.NewRequest("POST", "/select/logsql/field_values", bytes.NewBufferString("query=*"))
+		if _, err := forwardAndMerge(req, Route{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: tt.strategy}, endpoints); err != nil {
+			t.Fatalf("forwardAndMerge() failed: %v", err)
+		}
+		warned := strings.Contains(buf.String(), "warning: merged response of /select/logsql/field_values is")
+		if warned != tt.warn {
+			t.Errorf("%v %s: warned %v, want %v\n%s", tt.ratio, tt.strategy, warned, tt.warn, buf.String())
+		}
+	}
+}
+
+func TestMakeJSONHandler_mergeTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.WriteString(w, `{"values":[{"value":"A","hits":1}]}`); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}, {AccountID: "2", ProjectID: "p2", URL: server.URL}}
+
+	// a timed out merge keeps running until the transform returns, wait for
+	// it before the next case changes opts and before the cleanup
+	finished := make(chan struct{}, 1)
+	registerTransform("slow", func(merged []byte) ([]byte, error) {
+		defer func() { finished <- struct{}{} }()
+		time.Sleep(200 * time.Millisecond)
+		return merged, nil
+	})
+	defer delete(transforms, "slow")
+
+	tests := []struct {
+		timeout    time.Duration
+		transforms []string
+		wantCode   int
+	}{
+		{50 * time.Millisecond, []string{"slow"}, http.StatusInternalServerError},
+		{50 * time.Millisecond, nil, http.StatusOK},
+		{0, []string{"slow"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.MergeTimeout = tt.timeout })
+		route := Route{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: Sum, Transforms: tt.transforms}
+		rr := httptest.NewRecorder()
+		makeJSONHandler(route, endpoints).ServeHTTP(rr, httptest.NewRequest("POST", route.Path, bytes.NewBufferString("query=*")))
+		if rr.Code != tt.wantCode {
+			t.Errorf("%v %v: got %d %q, want %d", tt.timeout, tt.transforms, rr.Code, rr.Body.String(), tt.wantCode)
+		}
+		if tt.wantCode == http.StatusInternalServerError && !strings.Contains(rr.Body.String(), "merge timed out") {
+			t.Errorf("%v %v: got %q, want merge timed out", tt.timeout, tt.transforms, rr.Body.String())
+		}
+		if slices.Contains(tt.transforms, "slow") {
+			<-finished
+		}
+	}
+}
+
+// countingListener counts the bytes read from its connections.
+type countingListener struct {
+	net.Listener
+	n atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	return &countingConn{Conn: c, n: &l.n}, err
+}
+
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestMakeJSONHandler_expectContinue(t *testing.T) {
+	var gotExpect string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotExpect = r.Header.Get("Expect")
+		// rejected without reading the body, so no 100 Continue is sent
+		if r.URL.Query().Get("reject") == "1" {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed reading body: %v", err)
+		}
+		if _, err := fmt.Fprintf(w, `{"n":%d}`+"\n", len(body)); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	listener := &countingListener{Listener: server.Listener}
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+	body := "query=" + strings.Repeat("x", 1<<20)
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", strings.NewReader(body))
+	req.Header.Set("Expect", "100-continue")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != fmt.Sprintf(`{"n":%d}`+"\n", len(body)) || gotExpect != "100-continue" {
+		t.Errorf("accepted: got %d %q with Expect %q, want the whole body forwarded after 100 Continue", rr.Code, rr.Body.String(), gotExpect)
+	}
+
+	listener.n.Store(0)
+	req = httptest.NewRequest("POST", "/select/logsql/query?reject=1", strings.NewReader(body))
+	req.Header.Set("Expect", "100-continue")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("rejected: got %d %q, want the backend 413", rr.Code, rr.Body.String())
+	}
+	if n := listener.n.Load(); n >= int64(len(body)) {
+		t.Errorf("rejected: backend read %d bytes, want the body not to be sent", n)
+	}
+
+	gotExpect = ""
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", strings.NewReader("query=*")))
+	if rr.Code != http.StatusOK || gotExpect != "" {
+		t.Errorf("without Expect: got %d with Expect %q", rr.Code, gotExpect)
+	}
+}
+
+func TestForwardAndMerge_keepKeyOrder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `{"z":1,"status":"success"}`
+		if r.Header.Get("AccountID") == "2" {
+			body = `{"m":1,"a":2}`
+		}
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}, {AccountID: "2", ProjectID: "p2", URL: server.URL}}
+	route := Route{Path: "/select/logsql/facets", Format: JSON, MergeStrategy: Merge}
+
+	for _, tt := range []struct {
+		keep bool
+		want string
+	}{
+		{false, `{"a":2,"m":1,"status":"success","z":1}`},
+		{true, `{"z":1,"status":"success","m":1,"a":2}`},
+	} {
+		setOpts(t, func(o *Options) { o.KeepKeyOrder = tt.keep })
+		req := httptest.NewRequest("POST", route.Path, bytes.NewBufferString("query=*"))
+		got, err := forwardAndMerge(req, route, endpoints)
+		if err != nil {
+			t.Fatalf("forwardAndMerge() failed: %v", err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("keepKeyOrder %v: got %s, want %s", tt.keep, got, tt.want)
+		}
+	}
+
+	// the errors of the include policy are added without losing the order
+	setOpts(t, func(o *Options) {
+		o.KeepKeyOrder = true
+		o.JSONErrorPolicy = Include
+	})
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	endpoints = append(endpoints, Endpoint{AccountID: "3", ProjectID: "p3", URL: failing.URL})
+	req := httptest.NewRequest("POST", route.Path, bytes.NewBufferString("query=*"))
+	got, err := forwardAndMerge(req, route, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	if want := `{"z":1,"status":"success","m":1,"a":2,"errors":`; !strings.HasPrefix(string(got), want) {
+		t.Errorf("include policy: got %s, want prefix %s", got, want)
+	}
+}
+
+func TestLogBody_sampleRate(t *testing.T) {
+	defer func(r *rand.Rand) { sampleRand = r }(sampleRand)
+	sampleRand = rand.New(rand.NewPCG(1, 2))
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, rate := range []float64{0, 0.25, 1} {
+		setOpts(t, func(o *Options) { o.SampleRate = rate })
+		buf.Reset()
+
+		const n = 10000
+		for range n {
+			logBody([]byte("query=*"))
+		}
+
+		got := float64(strings.Count(buf.String(), "[REQ] body: query=*")) / n
+		if math.Abs(got-rate) > 0.02 {
+			t.Errorf("sampleRate %v: logged fraction %v", rate, got)
+		}
+	}
+}
+
+func TestMakeJSONHandler_mergedSample(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"_msg":"0123456789"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}, {AccountID: "2", ProjectID: "p2", URL: server.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, debug := range []bool{false, true} {
+		setOpts(t, func(o *Options) {
+			o.Debug = debug
+			o.MergedSample = 8
+		})
+		buf.Reset()
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		logged := strings.Contains(buf.String(), "[DEBUG]")
+		if logged != debug {
+			t.Errorf("debug %v: sample logged %v\n%s", debug, logged, buf.String())
+		}
+		if debug && !strings.Contains(buf.String(), `merged 44 bytes: "{\"_msg\":"`+"\n") {
+			t.Errorf("expected the first 8 of 44 bytes, got:\n%s", buf.String())
+		}
+	}
+}
+
+func TestForwardAndMerge_forwardHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		_, err := io.WriteString(w, `{"k":"v"}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		req.Header.Set("User-Agent", "grafana/11.0")
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		req.Header.Set("X-Custom", "custom")
+		return req
+	}
+
+	if _, err := getEndpointData(newRequest(), "/select/logsql/query", endpoints); err != nil {
+		t.Fatalf("getEndpointData() failed: %s", err)
+	}
+	if got.Get("Traceparent") != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent not forwarded: %v", got)
+	}
+	if got.Get("User-Agent") != "grafana/11.0" {
+		t.Errorf("User-Agent not forwarded: %v", got)
+	}
+	if got.Get("X-Custom") != "" {
+		t.Errorf("unexpected header forwarded: %v", got)
+	}
+
+	setOpts(t, func(o *Options) { o.ForwardHeaders = []string{"X-Custom"} })
+	if _, err := getEndpointData(newRequest(), "/select/logsql/query", endpoints); err != nil {
+		t.Fatalf("getEndpointData() failed: %s", err)
+	}
+	if got.Get("X-Custom") != "custom" || got.Get("Traceparent") != "" {
+		t.Errorf("configured header set not applied: %v", got)
+	}
+}
+
+func TestNewMux_routePrefix(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, err := io.WriteString(w, `{"k":"v"}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+
+	for _, prefix := range []string{"/vlmultiselect", "vlmultiselect/"} {
+		setOpts(t, func(o *Options) { o.RoutePrefix = prefix })
+		mux := newMux(endpoints, flag.NewFlagSet("test", flag.ContinueOnError))
+
+		gotPath = ""
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/vlmultiselect/select/logsql/query", bytes.NewBuffer([]byte("query=*"))))
+		if rr.Code != http.StatusOK {
+			t.Errorf("prefix %q: expected 200, got %d", prefix, rr.Code)
+		}
+		if gotPath != "/select/logsql/query" {
+			t.Errorf("prefix %q: backend got path %q", prefix, gotPath)
+		}
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/vlmultiselect/health", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("prefix %q: expected 200 for health, got %d", prefix, rr.Code)
+		}
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("prefix %q: expected 404 without prefix, got %d", prefix, rr.Code)
+		}
+	}
+}
+
+func TestMakeJSONHandler_maxMergedBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"n":1}`+"\n"+`{"n":2}`+"\n"+`{"n":3}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	tests := []struct {
+		limit         int
+		want          string
+		wantTruncated bool
+	}{
+		{20, `{"n":1}` + "\n" + `{"n":2}` + "\n", true},
+		{16, `{"n":1}` + "\n" + `{"n":2}` + "\n", true},
+		{5, "", true},
+		{24, `{"n":1}` + "\n" + `{"n":2}` + "\n" + `{"n":3}` + "\n", false},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.MaxMergedBytes = tt.limit })
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*"))))
+
+		if rr.Body.String() != tt.want {
+			t.Errorf("limit %d: got %q, want %q", tt.limit, rr.Body.String(), tt.want)
+		}
+		if truncated := rr.Header().Get("X-VLMultiselect-Truncated") == "true"; truncated != tt.wantTruncated {
+			t.Errorf("limit %d: truncated header = %v, want %v", tt.limit, truncated, tt.wantTruncated)
+		}
+	}
+}
+
+func TestNewMux_disableRoute(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{}`)
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+
+	setOpts(t, func(o *Options) { o.DisabledRoutes = []string{"/select/logsql/facets"} })
+	mux := newMux(endpoints, flag.NewFlagSet("test", flag.ContinueOnError))
+
+	for path, want := range map[string]int{
+		"/select/logsql/facets":     http.StatusNotFound,
+		"/select/logsql/streams":    http.StatusOK,
+		"/select/logsql/stream_ids": http.StatusOK,
+	} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", path, bytes.NewBuffer([]byte("query=*"))))
+		if rr.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rr.Code)
+		}
+	}
+}
+
+func TestMergeAndSumJSON_typedValues(t *testing.T) {
+	a := `{"values":[{"value":1,"hits":1},{"value":"1","hits":2},{"value":true,"hits":3},{"value":1.5,"hits":4}]}`
+	b := `{"values":[{"value":1,"hits":10},{"value":"1","hits":20},{"value":false,"hits":30},{"value":true,"hits":40},{"value":1.5,"hits":50}]}`
+
+	got, err := mergeAndSumJSON([]byte(a), []byte(b))
+	if err != nil {
+		t.Fatalf("mergeAndSumJSON() failed: %v", err)
+	}
+
+	var payload struct {
+		Values []struct {
+			Hits  int             `json:"hits"`
+			Value json.RawMessage `json:"value"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(got, &payload); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, got)
+	}
+	gotHits := map[string]int{}
+	for _, item := range payload.Values {
+		gotHits[string(item.Value)] = item.Hits
+	}
+	want := map[string]int{`1`: 11, `"1"`: 22, `true`: 43, `false`: 30, `1.5`: 54}
+	if !reflect.DeepEqual(gotHits, want) {
+		t.Errorf("got %v, want %v", gotHits, want)
+	}
+}
+
+func TestMergeData_sumMissingValue(t *testing.T) {
+	data := [][]byte{
+		[]byte(`{"values":[{"value":"A","hits":1},{"hits":2}]}`),
+		[]byte(`{"values":[{"value":null,"hits":3},{"value":"","hits":4}]}`),
+		[]byte(`{"values":[{"hits":5},{"value":"A","hits":6}]}`),
+	}
+	tests := []struct {
+		mode string
+		want map[string][]int
+	}{
+		{"", map[string][]int{`"A"`: {7}, `""`: {4}, `null`: {10}}},
+		{"merge", map[string][]int{`"A"`: {7}, `""`: {4}, `null`: {10}}},
+		{"skip", map[string][]int{`"A"`: {7}, `""`: {4}}},
+		{"separate", map[string][]int{`"A"`: {7}, `""`: {4}, `null`: {2, 3, 5}}},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.SumMissingValue = tt.mode })
+		got, err := mergeData(context.Background(), data, JSON, Sum)
+		if err != nil {
+			t.Fatalf("%q: mergeData() failed: %v", tt.mode, err)
+		}
+
+		var payload struct {
+			Values []struct {
+				Hits  int             `json:"hits"`
+				Value json.RawMessage `json:"value"`
+			} `json:"values"`
+		}
+		if err := json.Unmarshal(got, &payload); err != nil {
+			t.Fatalf("%q: json.Unmarshal failed: %v\nraw: %s", tt.mode, err, got)
+		}
+		gotHits := map[string][]int{}
+		for _, item := range payload.Values {
+			gotHits[string(item.Value)] = append(gotHits[string(item.Value)], item.Hits)
+		}
+		for _, hits := range gotHits {
+			slices.Sort(hits)
+		}
+		if !reflect.DeepEqual(gotHits, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.mode, gotHits, tt.want)
+		}
+	}
+}
+
+func TestMakeJSONHandler_maxQueryLength(t *testing.T) {
+	var called bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		_, err := io.WriteString(w, `{"n":1}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+	setOpts(t, func(o *Options) { o.MaxQueryLength = 20 })
+
+	// 8 bytes query string + 7 bytes body
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?limit=5", bytes.NewBuffer([]byte("query=*"))))
+	if rr.Code != http.StatusOK || !called {
+		t.Errorf("expected 200 below the limit, got %d", rr.Code)
+	}
+
+	called = false
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?limit=5", bytes.NewBuffer([]byte("query="+strings.Repeat("x", 20)))))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 above the limit, got %d", rr.Code)
+	}
+	if called {
+		t.Error("over-length request must not be forwarded")
+	}
+}
+
+func TestMakeJSONHandler_maxRequestBody(t *testing.T) {
+	var called bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		_, err := io.WriteString(w, `{"n":1}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+	setOpts(t, func(o *Options) { o.MaxRequestBody = 16 })
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*"))))
+	if rr.Code != http.StatusOK || !called {
+		t.Errorf("expected 200 below the limit, got %d", rr.Code)
+	}
+
+	called = false
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query="+strings.Repeat("x", 100)))))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 above the limit, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if called {
+		t.Error("oversized request must not be forwarded")
+	}
+}
+
+func TestMakeJSONHandler_byteOrderMark(t *testing.T) {
+	newServer := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+	bom := newServer("\ufeff" + `{"_msg":"a"}` + "\n" + `{"_msg":"b"}` + "\n")
+	defer bom.Close()
+	plain := newServer(`{"_msg":"c"}` + "\n")
+	defer plain.Close()
+	bomJSON := newServer("\ufeff" + `{"values":[{"value":"A","hits":1}]}`)
+	defer bomJSON.Close()
+	plainJSON := newServer(`{"values":[{"value":"A","hits":2}]}`)
+	defer plainJSON.Close()
+
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: bom.URL},
+		{AccountID: "2", ProjectID: "p2", URL: plain.URL},
+	})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBufferString("query=*")))
+	want := `{"_msg":"a"}` + "\n" + `{"_msg":"b"}` + "\n" + `{"_msg":"c"}` + "\n"
+	if rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("ndjson: got %d %q, want %q", rr.Code, rr.Body.String(), want)
+	}
+
+	handler = makeJSONHandler(Route{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: Sum}, []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: bomJSON.URL},
+		{AccountID: "2", ProjectID: "p2", URL: plainJSON.URL},
+	})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/field_values", bytes.NewBufferString("query=*")))
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"values":[{"hits":3,"value":"A"}]}` {
+		t.Errorf("json: got %d %q, want the summed values", rr.Code, rr.Body.String())
+	}
+}
+
+func TestForwardAndMerge_ndjsonChunked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher := w.(http.Flusher)
+		// chunks split lines in the middle, the last line has no newline
+		for _, chunk := range []string{`{"n":1}` + "\n" + `{"n"`, `:2}` + "\n", `{"n":3}` + "\n" + `{"n":4}`} {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				t.Errorf("failed responding: %v", err)
+				return
+			}
+			flusher.Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	var gotChunked atomic.Bool
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err == nil && slices.Contains(resp.TransferEncoding, "chunked") {
+			gotChunked.Store(true)
+		}
+		return resp, err
+	})}
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = client
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "2", ProjectID: "p2", URL: server.URL},
+	}
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	got, err := forwardAndMerge(req, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	if !gotChunked.Load() {
+		t.Error("backend response was not chunked")
+	}
+	lines := `{"n":1}` + "\n" + `{"n":2}` + "\n" + `{"n":3}` + "\n" + `{"n":4}` + "\n"
+	if want := lines + lines; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestForwardAndMerge_jsonStableOrder(t *testing.T) {
+	var endpoints []Endpoint
+	for _, node := range []string{"a", "b", "c"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, `{"status":"`+node+`","nodes":["`+node+`"]}`)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+	route := Route{Path: "/select/logsql/facets", Format: JSON, MergeStrategy: Merge}
+
+	var want string
+	for _, perm := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 0, 2}, {2, 0, 1}} {
+		permuted := []Endpoint{endpoints[perm[0]], endpoints[perm[1]], endpoints[perm[2]]}
+		req := httptest.NewRequest("POST", "/select/logsql/facets", bytes.NewBuffer([]byte("query=*")))
+		got, err := forwardAndMerge(req, route, permuted)
+		if err != nil {
+			t.Fatalf("forwardAndMerge() failed: %v", err)
+		}
+		if want == "" {
+			want = string(got)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("order %v: got %s, want %s", perm, got, want)
+		}
+	}
+}
+
+func TestLogEndpoints_quiet(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	endpoints, err := parseEndpointsFromFlags("1:p1,2:p2,3:p3", "node1:9428,node2:9428")
+	if err != nil {
+		t.Fatalf("parseEndpointsFromFlags() failed: %v", err)
+	}
+
+	logEndpoints(endpoints)
+	if n := strings.Count(buf.String(), "URL: "); n != 6 {
+		t.Errorf("expected 6 endpoint lines, got %d:\n%s", n, buf.String())
+	}
+
+	setOpts(t, func(o *Options) { o.Quiet = true })
+	buf.Reset()
+	logEndpoints(endpoints)
+	if got := strings.Count(buf.String(), "\n"); got != 1 {
+		t.Errorf("expected a single line, got %d:\n%s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), "configured 6 endpoints (2 storage nodes, 3 tenants)") {
+		t.Errorf("unexpected summary: %s", buf.String())
+	}
+}
+
+func TestCheckEndpointCount(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	endpoints, err := parseEndpointsFromFlags("1:p1,2:p2,3:p3", "node1:9428,node2:9428")
+	if err != nil {
+		t.Fatalf("parseEndpointsFromFlags() failed: %v", err)
+	}
+
+	setOpts(t, func(o *Options) { o.MaxEndpointsWarn = 6 })
+	if err := checkEndpointCount(endpoints); err != nil || buf.Len() != 0 {
+		t.Errorf("at the threshold: got error %v, log %q", err, buf.String())
+	}
+
+	setOpts(t, func(o *Options) { o.MaxEndpointsWarn = 5 })
+	if err := checkEndpointCount(endpoints); err != nil {
+		t.Errorf("past the threshold: unexpected error %v", err)
+	}
+	if !strings.Contains(buf.String(), "warning: 6 endpoints (2 storage nodes x 3 tenants) exceed -maxEndpointsWarn=5") {
+		t.Errorf("expected warning, got %q", buf.String())
+	}
+
+	setOpts(t, func(o *Options) { o.StrictEndpoints = true })
+	if err := checkEndpointCount(endpoints); err == nil {
+		t.Error("expected error with -strictEndpoints")
+	}
+}
+
+func TestMakeJSONHandler_formBody(t *testing.T) {
+	form := url.Values{"query": {`_msg:"a&b=c" | stats count() as "n+1"`}, "limit": {"10"}}.Encode()
+	const contentType = "application/x-www-form-urlencoded; charset=utf-8"
+
+	var gotBody, gotContentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed reading body: %v", err)
+		}
+		gotBody, gotContentType = string(body), r.Header.Get("Content-Type")
+		if values, _ := url.ParseQuery(gotBody); values.Get("query") != `_msg:"a&b=c" | stats count() as "n+1"` {
+			t.Errorf("backend parsed query %q", values.Get("query"))
+		}
+		if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	for _, dedup := range []bool{false, true} {
+		setOpts(t, func(o *Options) {
+			o.DedupRequests = dedup
+			o.MaxQueryLength = 1000
+		})
+		gotBody, gotContentType = "", ""
+		req := httptest.NewRequest("POST", "/select/logsql/query", strings.NewReader(form))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("dedup %v: expected 200, got %d", dedup, rr.Code)
+		}
+		if gotBody != form {
+			t.Errorf("dedup %v: backend got body %q, want %q", dedup, gotBody, form)
+		}
+		if gotContentType != contentType {
+			t.Errorf("dedup %v: backend got Content-Type %q, want %q", dedup, gotContentType, contentType)
+		}
+	}
+}
+
+func FuzzMergeAndSumJSON(f *testing.F) {
+	f.Add([]byte(`{"values":[{"value":"A","hits":1}]}`), []byte(`{"values":[{"value":"A","hits":2},{"value":1,"hits":3}]}`))
+	f.Add([]byte(`{}`), []byte(`{"values":null}`))
+	f.Add([]byte(`{"values":[{"value":{"a":[1]},"hits":1}]}`), []byte(`[]`))
+	f.Fuzz(func(t *testing.T, a, b []byte) {
+		out, err := mergeAndSumJSON(a, b)
+		if err == nil && !json.Valid(out) {
+			t.Errorf("invalid JSON output %q", out)
+		}
+	})
+}
+
+func FuzzMergeData(f *testing.F) {
+	f.Add([]byte(`{"values":[{"value":"A","hits":1}]}`), []byte(`{"values":[{"value":"A","hits":2}]}`), uint8(Sum))
+	f.Add([]byte(`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z"],"values":[1],"total":1}]}`), []byte(`{"hits":[]}`), uint8(Hits))
+	f.Add([]byte(`{"a":{"b":1}}`), []byte(`{"a":{"b":2.5},"c":[1]}`), uint8(DeepSum))
+	f.Add([]byte(`{"columns":["a"],"rows":[[1]]}`), []byte(`{"columns":["b"],"rows":[[2]]}`), uint8(Table))
+	f.Add([]byte(`[1,2]`), []byte(`{}`), uint8(Merge))
+	f.Add([]byte(`{"a":1}`), []byte(`{"a":"x"}`), uint8(Intersect))
+	strategies := []MergeStrategy{Merge, Sum, Intersect, Hits, DeepSum, Table}
+	f.Fuzz(func(t *testing.T, a, b []byte, strategy uint8) {
+		s := strategies[int(strategy)%len(strategies)]
+		out, err := mergeData(context.Background(), [][]byte{a, b}, JSON, s)
+		if err == nil && !json.Valid(out) {
+			t.Errorf("%s: invalid JSON output %q", s, out)
+		}
+		// must not panic, errors are fine
+		_, _ = mergeData(context.Background(), [][]byte{a, b}, NDJSON, Merge)
+		if out, err := keepFirstKeys(a); err == nil && !json.Valid(out) {
+			t.Errorf("keepFirstKeys: invalid JSON output %q", out)
+		}
+	})
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isArrayRooted reports whether b is a JSON document with an array at the top.
+func isArrayRooted(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && b[0] == '['
+}
+
+// concatJSONArrays concatenates array-rooted responses. Empty objects, as
+// returned by nodes without data, are ignored; any other object is an error
+// since it can't be combined with an array.
+func concatJSONArrays(data [][]byte) ([]byte, error) {
+	merged := []json.RawMessage{}
+	for _, b := range data {
+		if isArrayRooted(b) {
+			var items []json.RawMessage
+			if err := json.Unmarshal(b, &items); err != nil {
+				return nil, fmt.Errorf("unmarshal array: %w", err)
+			}
+			merged = append(merged, items...)
+			continue
+		}
+
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return nil, fmt.Errorf("unmarshal object: %w", err)
+		}
+		if len(obj) != 0 {
+			return nil, fmt.Errorf("cannot merge object-rooted response with array-rooted responses")
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// unwrapJSON extracts the value under key from every response, e.g. the
+// payload of {"status":"success","data":{...}}. Responses without the
+// wrapper are merged as they are. The returned envelope holds the remaining
+// top-level fields to restore with rewrapJSON, it is nil if no response had
+// the wrapper.
+func unwrapJSON(data [][]byte, key string) ([][]byte, map[string]json.RawMessage) {
+	var envelope map[string]json.RawMessage
+	inner := make([][]byte, 0, len(data))
+
+	for _, b := range data {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(b, &obj); err != nil || obj[key] == nil {
+			inner = append(inner, b)
+			continue
+		}
+		inner = append(inner, obj[key])
+
+		if envelope == nil {
+			envelope = map[string]json.RawMessage{}
+		}
+		for k, v := range obj {
+			if k == key {
+				continue
+			}
+			if _, ok := envelope[k]; !ok {
+				envelope[k] = v
+			}
+		}
+	}
+	return inner, envelope
+}
+
+// responseStatus returns the top-level "status" field of a JSON object
+// response, if any.
+func responseStatus(b []byte) (json.RawMessage, bool) {
+	var obj struct {
+		Status json.RawMessage `json:"status"`
+	}
+	if isArrayRooted(b) || json.Unmarshal(b, &obj) != nil || len(obj.Status) == 0 {
+		return nil, false
+	}
+	return obj.Status, true
+}
+
+// isSuccess reports whether a status field is "success".
+func isSuccess(status json.RawMessage) bool {
+	key, err := valueKey(status)
+	return err == nil && key == `"success"`
+}
+
+// mergeStatus sets the "status" of the merged object to the first status of
+// responses that isn't "success", see ErrorWins. Otherwise merged is
+// returned as it is.
+func mergeStatus(merged []byte, responses [][]byte) ([]byte, error) {
+	if isArrayRooted(merged) {
+		return merged, nil
+	}
+	for _, b := range responses {
+		status, ok := responseStatus(b)
+		if !ok || isSuccess(status) {
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(merged, &obj); err != nil {
+			return nil, fmt.Errorf("set merged status: %w", err)
+		}
+		if obj == nil {
+			return merged, nil
+		}
+		obj["status"] = status
+		return json.Marshal(obj)
+	}
+	return merged, nil
+}
+
+// failOnStatus marks results whose status isn't "success" as failed, see
+// FailOnStatus.
+func failOnStatus(results []endpointResult) {
+	for i, res := range results {
+		if res.Err != nil {
+			continue
+		}
+		if status, ok := responseStatus(res.Body); ok && !isSuccess(status) {
+			results[i].Err = fmt.Errorf("endpoint reported status %s", status)
+		}
+	}
+}
+
+// failOnErrorKey marks results with a top-level key as failed, for backends
+// that report errors like {"error":"..."} with status 200. A string value is
+// used as error message.
+func failOnErrorKey(results []endpointResult, key string) {
+	for i, res := range results {
+		var obj map[string]json.RawMessage
+		if res.Err != nil || isArrayRooted(res.Body) || json.Unmarshal(res.Body, &obj) != nil {
+			continue
+		}
+		value, ok := obj[key]
+		if !ok {
+			continue
+		}
+		var msg string
+		if json.Unmarshal(value, &msg) != nil {
+			msg = string(value)
+		}
+		results[i].Err = fmt.Errorf("endpoint reported %s: %s", key, msg)
+	}
+}
+
+// rewrapJSON puts merged under key and restores the envelope fields.
+func rewrapJSON(merged []byte, key string, envelope map[string]json.RawMessage) ([]byte, error) {
+	obj := make(map[string]json.RawMessage, len(envelope)+1)
+	for k, v := range envelope {
+		obj[k] = v
+	}
+	obj[key] = merged
+	return json.Marshal(obj)
+}
+
+// intersectValues keeps only the values[] entries whose value is present in
+// every response and sums their hits.
+func intersectValues(data [][]byte) ([]byte, error) {
+	type Item struct {
+		Hits  json.Number     `json:"hits"`
+		Value json.RawMessage `json:"value"`
+	}
+	type Payload struct {
+		Values []Item `json:"values"`
+	}
+
+	hits := map[string]json.Number{}
+	seen := map[string]int{}
+	var order []string
+	for i, b := range data {
+		var p Payload
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("unmarshal response %d: %w", i, err)
+		}
+		counted := map[string]bool{}
+		for _, item := range p.Values {
+			value, err := valueKey(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 && !counted[value] {
+				order = append(order, value)
+			}
+			hits[value] = addNumbers(cmp.Or(hits[value], "0"), item.Hits)
+			if !counted[value] {
+				counted[value] = true
+				seen[value]++
+			}
+		}
+	}
+
+	merged := Payload{Values: []Item{}}
+	for _, value := range order {
+		if seen[value] == len(data) {
+			merged.Values = append(merged.Values, Item{Hits: hits[value], Value: json.RawMessage(value)})
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// hitsSeries is a single series of a /select/logsql/hits response.
+type hitsSeries struct {
+	Fields     map[string]string `json:"fields"`
+	Timestamps []string          `json:"timestamps"`
+	Values     []int64           `json:"values"`
+	Total      int64             `json:"total"`
+}
+
+// mergeHits merges /select/logsql/hits responses. Series with the same
+// fields are combined by summing the values of equal timestamps; buckets
+// present on only some nodes are kept as they are.
+func mergeHits(data [][]byte) ([]byte, error) {
+	type Payload struct {
+		Hits []hitsSeries `json:"hits"`
+	}
+
+	var keys []string
+	series := map[string]*hitsSeries{}
+	buckets := map[string]map[string]int64{}
+	for i, b := range data {
+		var p Payload
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("unmarshal response %d: %w", i, err)
+		}
+		for _, s := range p.Hits {
+			if len(s.Timestamps) != len(s.Values) {
+				return nil, fmt.Errorf("response %d: %d timestamps for %d values", i, len(s.Timestamps), len(s.Values))
+			}
+			// json.Marshal sorts map keys, so equal fields give equal keys
+			rawKey, err := json.Marshal(s.Fields)
+			if err != nil {
+				return nil, err
+			}
+			key := string(rawKey)
+			if _, ok := series[key]; !ok {
+				keys = append(keys, key)
+				series[key] = &hitsSeries{Fields: s.Fields}
+				buckets[key] = map[string]int64{}
+			}
+			for j, ts := range s.Timestamps {
+				buckets[key][normalizeTimestamp(ts)] += s.Values[j]
+			}
+		}
+	}
+
+	merged := Payload{Hits: make([]hitsSeries, 0, len(keys))}
+	for _, key := range keys {
+		s := series[key]
+		s.Timestamps = make([]string, 0, len(buckets[key]))
+		for ts := range buckets[key] {
+			s.Timestamps = append(s.Timestamps, ts)
+		}
+		slices.SortFunc(s.Timestamps, compareTimestamps)
+		s.Values = make([]int64, len(s.Timestamps))
+		for j, ts := range s.Timestamps {
+			s.Values[j] = buckets[key][ts]
+			s.Total += s.Values[j]
+		}
+		merged.Hits = append(merged.Hits, *s)
+	}
+	return json.Marshal(merged)
+}
+
+// normalizeTimestamp returns an RFC 3339 timestamp in UTC, so buckets that
+// nodes report in different time zones, like 01:00:00+01:00 and 00:00:00Z,
+// are aligned. Anything else is returned as it is.
+func normalizeTimestamp(ts string) string {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return ts
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// compareTimestamps orders RFC 3339 timestamps chronologically and falls
+// back to string order for anything else.
+func compareTimestamps(a, b string) int {
+	ta, errA := time.Parse(time.RFC3339Nano, a)
+	tb, errB := time.Parse(time.RFC3339Nano, b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	return ta.Compare(tb)
+}
+
+// unionArrays removes duplicate elements from every array in the document,
+// keeping the first occurrence.
+func unionArrays(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("unmarshal merged response: %w", err)
+	}
+	doc, err := dedupArrays(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+func dedupArrays(v any) (any, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			deduped, err := dedupArrays(child)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = deduped
+		}
+		return v, nil
+
+	case []any:
+		seen := map[string]bool{}
+		out := make([]any, 0, len(v))
+		for _, child := range v {
+			deduped, err := dedupArrays(child)
+			if err != nil {
+				return nil, err
+			}
+			// encoding/json sorts map keys, so equal values encode equally
+			key, err := json.Marshal(deduped)
+			if err != nil {
+				return nil, err
+			}
+			if seen[string(key)] {
+				continue
+			}
+			seen[string(key)] = true
+			out = append(out, deduped)
+		}
+		return out, nil
+
+	default:
+		return v, nil
+	}
+}
+
+// deepSumJSON merges two documents by walking both recursively: object keys
+// are unioned, numbers at the same path are summed and arrays concatenated.
+// For any other conflict b wins, like with the Merge strategy.
+func deepSumJSON(a, b []byte) ([]byte, error) {
+	va, err := decodeJSON(a)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal a: %w", err)
+	}
+	vb, err := decodeJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal b: %w", err)
+	}
+	return json.Marshal(deepSum(va, vb))
+}
+
+// decodeJSON decodes b keeping numbers as json.Number.
+func decodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func deepSum(a, b any) any {
+	switch vb := b.(type) {
+	case map[string]any:
+		va, ok := a.(map[string]any)
+		if !ok {
+			return vb
+		}
+		for k, child := range vb {
+			if existing, ok := va[k]; ok {
+				va[k] = deepSum(existing, child)
+			} else {
+				va[k] = child
+			}
+		}
+		return va
+
+	case []any:
+		if va, ok := a.([]any); ok {
+			return append(va, vb...)
+		}
+		return vb
+
+	case json.Number:
+		if va, ok := a.(json.Number); ok {
+			return addNumbers(va, vb)
+		}
+		return vb
+
+	default:
+		return b
+	}
+}
+
+// addNumbers adds integers exactly and falls back to floats otherwise. The
+// sum is formatted according to -numberFormat.
+func addNumbers(a, b json.Number) json.Number {
+	ia, errA := a.Int64()
+	ib, errB := b.Int64()
+	if errA == nil && errB == nil {
+		return formatNumber(strconv.FormatInt(ia+ib, 10))
+	}
+	fa, _ := a.Float64()
+	fb, _ := b.Float64()
+	return formatNumber(strconv.FormatFloat(fa+fb, 'f', -1, 64))
+}
+
+// formatNumber appends ".0" to integer-valued sums if -numberFormat=float,
+// for parsers that expect every summed number to be a float.
+func formatNumber(s string) json.Number {
+	if opts.NumberFormat == "float" && !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return json.Number(s)
+}
+
+// formatNumbers applies -numberFormat to every number of b, so numbers
+// present on a single endpoint look like the summed ones.
+func formatNumbers(b []byte) ([]byte, error) {
+	if opts.NumberFormat != "float" {
+		return b, nil
+	}
+	v, err := decodeJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(formatLeaves(v))
+}
+
+func formatLeaves(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			v[k] = formatLeaves(child)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = formatLeaves(child)
+		}
+	case json.Number:
+		return formatNumber(string(v))
+	}
+	return v
+}
+
+// mergeWorkers returns the number of goroutines for JSON merges.
+func mergeWorkers() int {
+	if opts.MergeWorkers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return opts.MergeWorkers
+}
+
+// reduceParallel merges data as a balanced tree: each round merges adjacent
+// pairs concurrently on up to workers goroutines. Pairs keep their order, so
+// for an associative merge the result equals the sequential fold. It stops
+// between rounds once ctx is done.
+func reduceParallel(ctx context.Context, data [][]byte, merge func(a, b []byte) ([]byte, error), workers int) ([]byte, error) {
+	sem := make(chan struct{}, workers)
+	for len(data) > 1 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		next := make([][]byte, (len(data)+1)/2)
+		errs := make([]error, len(next))
+		var wg sync.WaitGroup
+		for i := range next {
+			if 2*i+1 == len(data) {
+				next[i] = data[2*i]
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				defer func() {
+					if p := recover(); p != nil {
+						errs[i] = fmt.Errorf("panic: %v", p)
+					}
+				}()
+				next[i], errs[i] = merge(data[2*i], data[2*i+1])
+			}(i)
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return nil, fmt.Errorf("json merge failed: %w", err)
+		}
+		data = next
+	}
+	return data[0], nil
+}
+
+// keepFirstKeys rewrites a JSON document so that objects with duplicate keys
+// keep the first value instead of the last one, which encoding/json and
+// jsons.Merge would keep. Key order is preserved.
+func keepFirstKeys(b []byte) ([]byte, error) {
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("duplicate keys: invalid JSON")
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	if err := copyFirstKeys(dec, &buf); err != nil {
+		return nil, fmt.Errorf("duplicate keys: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func copyFirstKeys(dec *json.Decoder, buf *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		raw, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		buf.Write(raw)
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		seen := map[string]bool{}
+		buf.WriteByte('{')
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, ok := tok.(string)
+			if !ok {
+				return fmt.Errorf("unexpected object key %v", tok)
+			}
+			var value bytes.Buffer
+			if err := copyFirstKeys(dec, &value); err != nil {
+				return err
+			}
+			if seen[key] {
+				continue
+			}
+			if len(seen) > 0 {
+				buf.WriteByte(',')
+			}
+			seen[key] = true
+			raw, _ := json.Marshal(key)
+			buf.Write(raw)
+			buf.WriteByte(':')
+			buf.Write(value.Bytes())
+		}
+		buf.WriteByte('}')
+	case '[':
+		buf.WriteByte('[')
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := copyFirstKeys(dec, buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	}
+	// closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// table is a tabular response with one value per column in every row.
+type table struct {
+	Columns []string            `json:"columns"`
+	Rows    [][]json.RawMessage `json:"rows"`
+}
+
+// mergeTables concatenates the rows of tabular responses. Nodes may return
+// different columns, so the result has the union of all columns in order of
+// appearance and every row gets null for the columns its node didn't return.
+func mergeTables(data [][]byte) ([]byte, error) {
+	var (
+		tables  []table
+		columns []string
+		index   = map[string]int{}
+	)
+	for _, b := range data {
+		var t table
+		if err := json.Unmarshal(b, &t); err != nil {
+			return nil, fmt.Errorf("table merge failed: %w", err)
+		}
+		for _, c := range t.Columns {
+			if _, ok := index[c]; !ok {
+				index[c] = len(columns)
+				columns = append(columns, c)
+			}
+		}
+		tables = append(tables, t)
+	}
+
+	merged := table{Columns: columns, Rows: [][]json.RawMessage{}}
+	if merged.Columns == nil {
+		merged.Columns = []string{}
+	}
+	for _, t := range tables {
+		for _, row := range t.Rows {
+			if len(row) != len(t.Columns) {
+				return nil, fmt.Errorf("table merge failed: row has %d values for %d columns", len(row), len(t.Columns))
+			}
+			aligned := make([]json.RawMessage, len(columns))
+			for i := range aligned {
+				aligned[i] = json.RawMessage("null")
+			}
+			for i, v := range row {
+				aligned[index[t.Columns[i]]] = v
+			}
+			merged.Rows = append(merged.Rows, aligned)
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// orderKeys rewrites the objects of merged with their keys in the order they
+// were first seen in responses, see -keepKeyOrder. Objects are matched by
+// their path, elements of an array share one. Keys no response has, e.g.
+// added by a transform, follow in sorted order.
+func orderKeys(merged []byte, responses [][]byte) ([]byte, error) {
+	order := map[string][]string{}
+	seen := map[string]bool{}
+	for _, b := range responses {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		// unparsable responses were rejected by the merge already
+		_ = recordKeys(dec, "", order, seen)
+	}
+	var buf bytes.Buffer
+	if err := writeOrdered(&buf, merged, "", order); err != nil {
+		return nil, fmt.Errorf("key order: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// recordKeys appends the object keys of the value read from dec to order,
+// keyed by path, unless seen already.
+func recordKeys(dec *json.Decoder, path string, order map[string][]string, seen map[string]bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	switch delim {
+	case '{':
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, ok := tok.(string)
+			if !ok {
+				return fmt.Errorf("unexpected object key %v", tok)
+			}
+			if id := path + "\x00" + key; !seen[id] {
+				seen[id] = true
+				order[path] = append(order[path], key)
+			}
+			if err := recordKeys(dec, path+"\x00"+key, order, seen); err != nil {
+				return err
+			}
+		}
+	case '[':
+		for dec.More() {
+			if err := recordKeys(dec, path+"\x00[]", order, seen); err != nil {
+				return err
+			}
+		}
+	}
+	// closing delimiter
+	_, err = dec.Token()
+	return err
+}
+
+// writeOrdered writes raw to buf with the keys of its objects in order.
+func writeOrdered(buf *bytes.Buffer, raw []byte, path string, order map[string][]string) error {
+	raw = bytes.TrimSpace(raw)
+	switch {
+	case len(raw) > 0 && raw[0] == '{':
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(obj))
+		placed := make(map[string]bool, len(obj))
+		for _, key := range order[path] {
+			if _, ok := obj[key]; ok {
+				keys = append(keys, key)
+				placed[key] = true
+			}
+		}
+		var rest []string
+		for key := range obj {
+			if !placed[key] {
+				rest = append(rest, key)
+			}
+		}
+		slices.Sort(rest)
+		keys = append(keys, rest...)
+
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			name, _ := json.Marshal(key)
+			buf.Write(name)
+			buf.WriteByte(':')
+			if err := writeOrdered(buf, obj[key], path+"\x00"+key, order); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case len(raw) > 0 && raw[0] == '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return err
+		}
+		buf.WriteByte('[')
+		for i, item := range items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeOrdered(buf, item, path+"\x00[]", order); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		buf.Write(raw)
+	}
+	return nil
+}
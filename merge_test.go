@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeData_arrayRooted(t *testing.T) {
+	tests := []struct {
+		comment string
+		data    []string
+		strat   MergeStrategy
+		wantErr bool
+		want    string
+	}{
+		{"arrays only", []string{`[{"a":1}]`, `[{"b":2},{"c":3}]`}, Merge, false, `[{"a":1},{"b":2},{"c":3}]`},
+		{"empty object and array", []string{`{}`, `[{"a":1}]`}, Merge, false, `[{"a":1}]`},
+		{"array and empty object with sum", []string{` [1,2]`, `{ }`}, Sum, false, `[1,2]`},
+		{"object and array", []string{`{"a":1}`, `[{"b":2}]`}, Merge, true, ""},
+		{"objects only", []string{`{"a":1}`, `{"b":2}`}, Merge, false, `{"a":1,"b":2}`},
+		{"invalid array", []string{`[1,`, `[2]`}, Merge, true, ""},
+	}
+
+	for _, tt := range tests {
+		data := make([][]byte, len(tt.data))
+		for i, d := range tt.data {
+			data[i] = []byte(d)
+		}
+
+		got, err := mergeData(context.Background(), data, JSON, tt.strat)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: mergeData() error = %v, wantErr %v", tt.comment, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.comment, got, tt.want)
+		}
+	}
+}
+
+func TestAppendErrors_arrayRooted(t *testing.T) {
+	failed := []endpointResult{{
+		Endpoint: Endpoint{AccountID: "1", ProjectID: "p1", URL: "http://node1"},
+		Err:      errors.New("boom"),
+	}}
+	got, err := appendErrors([]byte(`[{"a":1}]`), JSON, failed)
+	if err != nil {
+		t.Fatalf("appendErrors() failed: %v", err)
+	}
+	want := `[{"a":1},{"_error":{"url":"http://node1","accountID":"1","projectID":"p1","error":"boom"}}]`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMakeJSONHandler_unwrap(t *testing.T) {
+	tests := []struct {
+		comment string
+		outputs []string
+		want    string
+	}{
+		{"both wrapped",
+			[]string{
+				`{"status":"success","data":{"values":[{"value":"A","hits":1}]}}`,
+				`{"status":"success","data":{"values":[{"value":"A","hits":2}]}}`,
+			},
+			`{"status":"success","data":{"values":[{"value":"A","hits":3}]}}`},
+		{"one node failed",
+			[]string{
+				`{"status":"success","data":{"values":[{"value":"A","hits":1}]}}`,
+				`{"status":"error","data":{"values":[]}}`,
+			},
+			`{"status":"error","data":{"values":[{"value":"A","hits":1}]}}`},
+		{"unwrapped response",
+			[]string{
+				`{"status":"success","data":{"values":[{"value":"A","hits":1}]}}`,
+				`{"values":[{"value":"B","hits":2}]}`,
+			},
+			`{"status":"success","data":{"values":[{"value":"A","hits":1},{"value":"B","hits":2}]}}`},
+		{"no wrapped response",
+			[]string{
+				`{"values":[{"value":"A","hits":1}]}`,
+				`{"values":[{"value":"B","hits":2}]}`,
+			},
+			`{"values":[{"value":"A","hits":1},{"value":"B","hits":2}]}`},
+	}
+
+	for _, tt := range tests {
+		var endpoints []Endpoint
+		for _, out := range tt.outputs {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, err := io.WriteString(w, out)
+				if err != nil {
+					t.Fatalf("failed responding: %v", err)
+				}
+			}))
+			defer server.Close()
+			endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+		}
+
+		route := Route{Path: "/select/logsql/field_names", Format: JSON, MergeStrategy: Sum, Unwrap: "data"}
+		req := httptest.NewRequest("POST", route.Path, bytes.NewBuffer([]byte("query=*")))
+		rr := httptest.NewRecorder()
+		makeJSONHandler(route, endpoints).ServeHTTP(rr, req)
+
+		var got, want map[string]any
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: json.Unmarshal failed: %v\nraw: %s", tt.comment, err, rr.Body.String())
+		}
+		if err := json.Unmarshal([]byte(tt.want), &want); err != nil {
+			t.Fatalf("%s: json.Unmarshal(want) failed: %v", tt.comment, err)
+		}
+		normalize(got["data"])
+		normalize(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.comment, got, want)
+		}
+	}
+}
+
+func TestMergeData_intersect(t *testing.T) {
+	tests := []struct {
+		comment string
+		data    []string
+		want    string
+	}{
+		{"partial overlap",
+			[]string{
+				`{"values":[{"value":"A","hits":1},{"value":"B","hits":2},{"value":"C","hits":3}]}`,
+				`{"values":[{"value":"B","hits":10},{"value":"C","hits":20},{"value":"D","hits":30}]}`,
+				`{"values":[{"value":"C","hits":100},{"value":"B","hits":200}]}`,
+			},
+			`{"values":[{"hits":212,"value":"B"},{"hits":123,"value":"C"}]}`},
+		{"no overlap",
+			[]string{`{"values":[{"value":"A","hits":1}]}`, `{"values":[{"value":"B","hits":1}]}`},
+			`{"values":[]}`},
+		{"empty endpoint",
+			[]string{`{"values":[{"value":"A","hits":1}]}`, `{}`},
+			`{"values":[]}`},
+		{"non-integer hits",
+			[]string{`{"values":[{"value":"A","hits":1.5}]}`, `{"values":[{"value":"A","hits":2}]}`},
+			`{"values":[{"hits":3.5,"value":"A"}]}`},
+		{"hits above int64",
+			[]string{`{"values":[{"value":"A","hits":9223372036854775808}]}`, `{"values":[{"value":"A","hits":0}]}`},
+			`{"values":[{"hits":9223372036854776000,"value":"A"}]}`},
+	}
+
+	for _, tt := range tests {
+		data := make([][]byte, len(tt.data))
+		for i, d := range tt.data {
+			data[i] = []byte(d)
+		}
+		got, err := mergeData(context.Background(), data, JSON, Intersect)
+		if err != nil {
+			t.Fatalf("%s: mergeData() failed: %v", tt.comment, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.comment, got, tt.want)
+		}
+	}
+
+	setOpts(t, func(o *Options) { o.NumberFormat = "float" })
+	data := [][]byte{[]byte(`{"values":[{"value":"A","hits":1}]}`), []byte(`{"values":[{"value":"A","hits":2}]}`)}
+	got, err := mergeData(context.Background(), data, JSON, Intersect)
+	if want := `{"values":[{"hits":3.0,"value":"A"}]}`; err != nil || string(got) != want {
+		t.Errorf("-numberFormat=float: got %s, %v, want %s", got, err, want)
+	}
+}
+
+func TestForwardAndMerge_streamIDs(t *testing.T) {
+	responses := []string{
+		`{"values":[{"value":"{stream-a}","hits":1},{"value":"{stream-b}","hits":2}]}`,
+		`{"values":[{"value":"{stream-b}","hits":10},{"value":"{stream-c}","hits":20}]}`,
+	}
+	var endpoints []Endpoint
+	for _, resp := range responses {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, resp)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	var route Route
+	for _, r := range routes {
+		if r.Path == "/select/logsql/stream_ids" {
+			route = r
+		}
+	}
+	if route.MergeStrategy != Sum {
+		t.Fatalf("expected stream_ids to use the sum strategy, got %s", route.MergeStrategy)
+	}
+
+	req := httptest.NewRequest("POST", route.Path, bytes.NewBuffer([]byte("query=*")))
+	got, err := forwardAndMerge(req, route, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	// JSON results are merged in sorted endpoint order, which depends on
+	// the test server ports, so only the set of values is compared
+	var payload struct {
+		Values []struct {
+			Hits  int    `json:"hits"`
+			Value string `json:"value"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(got, &payload); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, got)
+	}
+	gotHits := map[string]int{}
+	for _, v := range payload.Values {
+		gotHits[v.Value] = v.Hits
+	}
+	want := map[string]int{"{stream-a}": 1, "{stream-b}": 12, "{stream-c}": 20}
+	if len(payload.Values) != len(want) || !reflect.DeepEqual(gotHits, want) {
+		t.Errorf("got %s, want each of %v once", got, want)
+	}
+}
+
+func TestMergeData_hits(t *testing.T) {
+	tests := []struct {
+		comment string
+		data    []string
+		want    string
+	}{
+		{"aligned buckets",
+			[]string{
+				`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z","2024-01-01T01:00:00Z"],"values":[1,2],"total":3}]}`,
+				`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z","2024-01-01T01:00:00Z"],"values":[10,20],"total":30}]}`,
+			},
+			`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z","2024-01-01T01:00:00Z"],"values":[11,22],"total":33}]}`},
+		{"misaligned buckets",
+			[]string{
+				`{"hits":[{"fields":{},"timestamps":["2024-01-01T01:00:00Z","2024-01-01T02:00:00Z"],"values":[2,3],"total":5}]}`,
+				`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z","2024-01-01T01:00:00Z"],"values":[10,20],"total":30}]}`,
+			},
+			`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z","2024-01-01T01:00:00Z","2024-01-01T02:00:00Z"],"values":[10,22,3],"total":35}]}`},
+		{"series by fields",
+			[]string{
+				`{"hits":[{"fields":{"level":"error"},"timestamps":["2024-01-01T00:00:00Z"],"values":[1],"total":1},{"fields":{"level":"info"},"timestamps":["2024-01-01T00:00:00Z"],"values":[5],"total":5}]}`,
+				`{"hits":[{"fields":{"level":"error"},"timestamps":["2024-01-01T00:00:00Z"],"values":[2],"total":2}]}`,
+			},
+			`{"hits":[{"fields":{"level":"error"},"timestamps":["2024-01-01T00:00:00Z"],"values":[3],"total":3},{"fields":{"level":"info"},"timestamps":["2024-01-01T00:00:00Z"],"values":[5],"total":5}]}`},
+		{"time zones",
+			[]string{
+				`{"hits":[{"fields":{},"timestamps":["2024-01-01T01:00:00+01:00","2024-01-01T02:00:00+01:00"],"values":[1,2],"total":3}]}`,
+				`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z","2024-01-01T01:00:00.000Z"],"values":[10,20],"total":30}]}`,
+				`{"hits":[{"fields":{},"timestamps":["2023-12-31T19:00:00-05:00"],"values":[100],"total":100}]}`,
+			},
+			`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z","2024-01-01T01:00:00Z"],"values":[111,22],"total":133}]}`},
+		{"empty node",
+			[]string{`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z"],"values":[1],"total":1}]}`, `{}`},
+			`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z"],"values":[1],"total":1}]}`},
+	}
+
+	for _, tt := range tests {
+		data := make([][]byte, len(tt.data))
+		for i, d := range tt.data {
+			data[i] = []byte(d)
+		}
+		got, err := mergeData(context.Background(), data, JSON, Hits)
+		if err != nil {
+			t.Fatalf("%s: mergeData() failed: %v", tt.comment, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s:\n  got:  %s\n  want: %s", tt.comment, got, tt.want)
+		}
+	}
+
+	if _, err := mergeData(context.Background(), [][]byte{[]byte(`{"hits":[{"fields":{},"timestamps":["2024-01-01T00:00:00Z"],"values":[]}]}`)}, JSON, Hits); err == nil {
+		t.Error("expected error for mismatched timestamps and values")
+	}
+}
+
+func TestForwardAndMerge_arrayMerge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"values":[{"value":"A","hits":1},{"value":"B","hits":2}],"tags":["x","y"]}`)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	// the same node queried three times
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+	}
+
+	tests := []struct {
+		arrayMerge ArrayMerge
+		wantValues int
+		wantTags   int
+	}{
+		{Append, 6, 6},
+		{Union, 2, 2},
+	}
+	for _, tt := range tests {
+		route := Route{Path: "/select/logsql/streams", Format: JSON, MergeStrategy: Merge, ArrayMerge: tt.arrayMerge}
+		req := httptest.NewRequest("POST", route.Path, bytes.NewBuffer([]byte("query=*")))
+		got, err := forwardAndMerge(req, route, endpoints)
+		if err != nil {
+			t.Fatalf("forwardAndMerge() failed: %v", err)
+		}
+
+		var payload struct {
+			Values []any `json:"values"`
+			Tags   []any `json:"tags"`
+		}
+		if err := json.Unmarshal(got, &payload); err != nil {
+			t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, got)
+		}
+		if len(payload.Values) != tt.wantValues || len(payload.Tags) != tt.wantTags {
+			t.Errorf("arrayMerge %d: got %d values and %d tags, want %d and %d", tt.arrayMerge, len(payload.Values), len(payload.Tags), tt.wantValues, tt.wantTags)
+		}
+	}
+}
+
+func TestUnionArrays(t *testing.T) {
+	got, err := unionArrays([]byte(`{"a":[1,1.0,2,{"x":1,"y":2},{"y":2,"x":1}],"b":{"c":[[1],[1]]}}`))
+	if err != nil {
+		t.Fatalf("unionArrays() failed: %v", err)
+	}
+	// 1 and 1.0 are different literals and kept apart
+	want := `{"a":[1,1.0,2,{"x":1,"y":2}],"b":{"c":[[1]]}}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMergeData_deepSum(t *testing.T) {
+	data := [][]byte{
+		[]byte(`{"stats":{"requests":{"total":10,"errors":1},"bytes":1.5,"node":"a"},"tags":["a"]}`),
+		[]byte(`{"stats":{"requests":{"total":5,"retries":2},"bytes":2.25,"node":"b"},"tags":["b"],"uptime":7}`),
+	}
+	got, err := mergeData(context.Background(), data, JSON, DeepSum)
+	if err != nil {
+		t.Fatalf("mergeData() failed: %v", err)
+	}
+	want := `{"stats":{"bytes":3.75,"node":"b","requests":{"errors":1,"retries":2,"total":15}},"tags":["a","b"],"uptime":7}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := mergeData(context.Background(), [][]byte{[]byte(`{"a":`)}, JSON, DeepSum); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestMergeData_seed(t *testing.T) {
+	tests := []struct {
+		strategy MergeStrategy
+		data     []string
+		want     string
+	}{
+		{Merge, []string{`{"a":{"b":[1]},"c":null}`}, `{"a":{"b":[1]},"c":null}`},
+		{Merge, nil, `{}`},
+		{Sum, []string{`{"values":[{"value":"A","hits":1}]}`}, `{"values":[{"hits":1,"value":"A"}]}`},
+		{Sum, []string{`{}`}, `{"values":[]}`},
+		{Sum, nil, `{"values":[]}`},
+		{DeepSum, []string{`{"n":1,"m":{"k":[]}}`}, `{"m":{"k":[]},"n":1}`},
+		{DeepSum, nil, `{}`},
+	}
+	for _, tt := range tests {
+		data := make([][]byte, len(tt.data))
+		for i, d := range tt.data {
+			data[i] = []byte(d)
+		}
+		got, err := mergeData(context.Background(), data, JSON, tt.strategy)
+		if err != nil {
+			t.Fatalf("%s %v: mergeData() failed: %v", tt.strategy, tt.data, err)
+		}
+		if !jsonEqual(t, got, []byte(tt.want)) {
+			t.Errorf("%s %v: got %s, want %s", tt.strategy, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMergeData_numberFormat(t *testing.T) {
+	tests := []struct {
+		format   string
+		strategy MergeStrategy
+		data     []string
+		want     string
+	}{
+		{"int", Sum,
+			[]string{`{"values":[{"value":"A","hits":40}]}`, `{"values":[{"value":"A","hits":6}]}`},
+			`{"values":[{"hits":46,"value":"A"}]}`},
+		{"float", Sum,
+			[]string{`{"values":[{"value":"A","hits":40}]}`, `{"values":[{"value":"A","hits":6}]}`},
+			`{"values":[{"hits":46.0,"value":"A"}]}`},
+		{"int", Sum,
+			[]string{`{"values":[{"value":"A","hits":0.5}]}`, `{"values":[{"value":"A","hits":1.5}]}`},
+			`{"values":[{"hits":2,"value":"A"}]}`},
+		{"float", Sum,
+			[]string{`{"values":[{"value":"A","hits":0.5}]}`, `{"values":[{"value":"A","hits":1.25}]}`},
+			`{"values":[{"hits":1.75,"value":"A"}]}`},
+		{"int", DeepSum,
+			[]string{`{"bytes":1.5,"n":1}`, `{"bytes":1.5,"n":2}`},
+			`{"bytes":3,"n":3}`},
+		{"float", DeepSum,
+			[]string{`{"bytes":1.5,"n":1}`, `{"bytes":1.5,"n":2}`},
+			`{"bytes":3.0,"n":3.0}`},
+		{"float", DeepSum,
+			[]string{`{"a":1,"big":1e3}`, `{"a":2,"b":1,"c":{"d":[4,0.5]}}`},
+			`{"a":3.0,"b":1.0,"big":1e3,"c":{"d":[4.0,0.5]}}`},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.NumberFormat = tt.format })
+		data := make([][]byte, len(tt.data))
+		for i, d := range tt.data {
+			data[i] = []byte(d)
+		}
+		got, err := mergeData(context.Background(), data, JSON, tt.strategy)
+		if err != nil {
+			t.Fatalf("%s/%s: mergeData() failed: %v", tt.format, tt.strategy, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s/%s: got %s, want %s", tt.format, tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestForwardAndMerge_queryArrayResponses(t *testing.T) {
+	outputs := []string{
+		`[{"_msg":"a1"},{"_msg":"a2"}]`,
+		"[\n  {\"_msg\": \"b1\"},\n  {\"_msg\": \"b2\"}\n]\n",
+	}
+	var endpoints []Endpoint
+	for _, out := range outputs {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, out)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{NDJSON, `{"_msg":"a1"}` + "\n" + `{"_msg":"a2"}` + "\n" + `{"_msg":"b1"}` + "\n" + `{"_msg":"b2"}` + "\n"},
+		{JSON, `[{"_msg":"a1"},{"_msg":"a2"},{"_msg":"b1"},{"_msg":"b2"}]`},
+	}
+	for _, tt := range tests {
+		route := Route{Path: "/select/logsql/query", Format: tt.format, MergeStrategy: Merge}
+		req := httptest.NewRequest("POST", route.Path, bytes.NewBuffer([]byte("query=*")))
+		got, err := forwardAndMerge(req, route, endpoints)
+		if err != nil {
+			t.Fatalf("%s: forwardAndMerge() failed: %v", tt.format, err)
+		}
+		var compact bytes.Buffer
+		if tt.format == JSON {
+			if err := json.Compact(&compact, got); err != nil {
+				t.Fatalf("json.Compact failed: %v", err)
+			}
+			got = compact.Bytes()
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestMergeData_parallelEqualsSequential(t *testing.T) {
+	var data [][]byte
+	for i := range 13 {
+		data = append(data, []byte(fmt.Sprintf(`{"total":%d,"node%d":{"hits":%d},"shared":{"hits":1,"tags":["t%d"]}}`, i, i%4, i, i)))
+	}
+
+	var values [][]byte
+	for i := range 13 {
+		values = append(values, []byte(fmt.Sprintf(`{"values":[{"value":"v%d","hits":%d},{"value":"shared","hits":1}]}`, i%5, i)))
+	}
+
+	// the right operand wins a type conflict, so a tree would end up with a
+	// different winner
+	conflicts := [][]byte{[]byte(`{"a":1}`), []byte(`{"a":"s"}`), []byte(`{"a":1}`), []byte(`{"a":1}`)}
+
+	for _, tt := range []struct {
+		strategy MergeStrategy
+		data     [][]byte
+	}{
+		{Merge, data},
+		{DeepSum, data},
+		{DeepSum, conflicts},
+		{Sum, values},
+	} {
+		setOpts(t, func(o *Options) { o.MergeWorkers = 1 })
+		want, err := mergeData(context.Background(), tt.data, JSON, tt.strategy)
+		if err != nil {
+			t.Fatalf("%s: sequential mergeData() failed: %v", tt.strategy, err)
+		}
+		for _, workers := range []int{2, 3, 8} {
+			setOpts(t, func(o *Options) { o.MergeWorkers = workers })
+			got, err := mergeData(context.Background(), tt.data, JSON, tt.strategy)
+			if err != nil {
+				t.Fatalf("%s: parallel mergeData() failed: %v", tt.strategy, err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("%s with %d workers:\ngot  %s\nwant %s", tt.strategy, workers, got, want)
+			}
+		}
+	}
+}
+
+func TestMergeData_parallelConflicts(t *testing.T) {
+	// the sequential fold fails on x, a tree would merge the last two first
+	// and fail on y
+	data := [][]byte{[]byte(`{"x":1}`), []byte(`{"x":"s"}`), []byte(`{}`), []byte(`{"y":true}`), []byte(`{"y":"t"}`)}
+
+	setOpts(t, func(o *Options) { o.MergeWorkers = 1 })
+	_, want := mergeData(context.Background(), data, JSON, Merge)
+	if want == nil {
+		t.Fatal("sequential mergeData() succeeded, want a type mismatch")
+	}
+	setOpts(t, func(o *Options) { o.MergeWorkers = 4 })
+	_, got := mergeData(context.Background(), data, JSON, Merge)
+	if got == nil || got.Error() != want.Error() {
+		t.Errorf("parallel merge error %v, want the sequential %v", got, want)
+	}
+}
+
+func TestMergeData_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data := [][]byte{[]byte(`{"values":[{"value":"a","hits":1}]}`), []byte(`{"values":[{"value":"b","hits":2}]}`)}
+
+	for _, workers := range []int{1, 4} {
+		setOpts(t, func(o *Options) { o.MergeWorkers = workers })
+		if _, err := mergeData(ctx, data, JSON, Sum); !errors.Is(err, context.Canceled) {
+			t.Errorf("%d workers: expected context.Canceled, got %v", workers, err)
+		}
+	}
+	if _, err := mergeData(ctx, data, NDJSON, Merge); !errors.Is(err, context.Canceled) {
+		t.Errorf("ndjson: expected context.Canceled, got %v", err)
+	}
+	if _, err := mergeSortedLines(ctx, data, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("sorted lines: expected context.Canceled, got %v", err)
+	}
+}
+
+func BenchmarkMergeData(b *testing.B) {
+	var data [][]byte
+	for i := range 64 {
+		var sb strings.Builder
+		sb.WriteString(`{"values":[`)
+		for k := range 200 {
+			if k > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, `{"value":"field%d","hits":%d}`, (k+i)%300, k)
+		}
+		sb.WriteString("]}")
+		data = append(data, []byte(sb.String()))
+	}
+
+	for _, workers := range []int{1, 0} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			defer func(o Options) { opts = o }(opts)
+			opts.MergeWorkers = workers
+			for b.Loop() {
+				if _, err := mergeData(context.Background(), data, JSON, Sum); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepFirstKeys(t *testing.T) {
+	in := `{"a":1,"b":{"x":"first","x":"last"},"a":2,"c":[{"k":1,"k":2}],"n":1.50}`
+	want := `{"a":1,"b":{"x":"first"},"c":[{"k":1}],"n":1.50}`
+	got, err := keepFirstKeys([]byte(in))
+	if err != nil {
+		t.Fatalf("keepFirstKeys() failed: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestForwardAndMerge_duplicateKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"status":"first","status":"last","data":{"n":1,"n":2}}`)
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", `{"data":{"n":2},"status":"last"}`},
+		{"last", `{"data":{"n":2},"status":"last"}`},
+		{"first", `{"data":{"n":1},"status":"first"}`},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.DuplicateKeys = tt.mode })
+		req := httptest.NewRequest("POST", "/select/logsql/facets", bytes.NewBuffer([]byte("query=*")))
+		got, err := forwardAndMerge(req, Route{Path: "/select/logsql/facets", Format: JSON, MergeStrategy: Merge}, endpoints)
+		if err != nil {
+			t.Fatalf("%q: forwardAndMerge() failed: %v", tt.mode, err)
+		}
+		if !jsonEqual(t, got, []byte(tt.want)) {
+			t.Errorf("%q: got %s, want %s", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestForwardAndMerge_status(t *testing.T) {
+	var endpoints []Endpoint
+	for _, out := range []string{
+		`{"status":"success","data":{"a":1}}`,
+		`{"status":"error","error":"boom"}`,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, out)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	tests := []struct {
+		comment string
+		status  StatusPolicy
+		policy  ErrorPolicy
+		wantErr bool
+		want    string
+	}{
+		// JSON is merged in sorted endpoint order, which depends on the
+		// test server ports, so the error must win from either position
+		{"error wins", ErrorWins, Fail, false, `{"status":"error","data":{"a":1},"error":"boom"}`},
+		{"fail on status", FailOnStatus, Fail, true, ""},
+		{"fail on status, skipped", FailOnStatus, Skip, false, `{"status":"success","data":{"a":1}}`},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.JSONErrorPolicy = tt.policy })
+		route := Route{Path: "/select/logsql/facets", Format: JSON, MergeStrategy: Merge, Status: tt.status}
+		req := httptest.NewRequest("POST", route.Path, bytes.NewBuffer([]byte("query=*")))
+		got, err := forwardAndMerge(req, route, endpoints)
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), `status "error"`) {
+				t.Errorf("%s: expected status error, got %v", tt.comment, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: forwardAndMerge() failed: %v", tt.comment, err)
+		}
+		if !jsonEqual(t, got, []byte(tt.want)) {
+			t.Errorf("%s: got %s, want %s", tt.comment, got, tt.want)
+		}
+	}
+
+	// a single endpoint is passed through, but not with a failed status
+	setOpts(t, func(o *Options) { o.JSONErrorPolicy = Fail })
+	route := Route{Path: "/select/logsql/facets", Format: JSON, MergeStrategy: Merge, Status: FailOnStatus}
+	req := httptest.NewRequest("POST", route.Path, bytes.NewBuffer([]byte("query=*")))
+	if _, err := forwardAndMerge(req, route, endpoints[1:]); err == nil || !strings.Contains(err.Error(), `status "error"`) {
+		t.Errorf("single endpoint: expected status error, got %v", err)
+	}
+
+	var p StatusPolicy
+	if err := p.UnmarshalText([]byte("fail")); err != nil || p != FailOnStatus {
+		t.Errorf("UnmarshalText(fail) = %v, policy %d", err, p)
+	}
+	if err := p.UnmarshalText([]byte("overwrite")); err == nil {
+		t.Error("expected error for unknown status policy")
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var va, vb any
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, a)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestMergeData_table(t *testing.T) {
+	data := [][]byte{
+		[]byte(`{"columns":["level","count"],"rows":[["info",3],["error",1]]}`),
+		[]byte(`{"columns":["level","host","count"],"rows":[["info","h1",2]]}`),
+		[]byte(`{"columns":["count","level"],"rows":[[5,"warn"]]}`),
+		[]byte(`{}`),
+	}
+	got, err := mergeData(context.Background(), data, JSON, Table)
+	if err != nil {
+		t.Fatalf("mergeData() failed: %v", err)
+	}
+	want := `{"columns":["level","count","host"],"rows":[["info",3,null],["error",1,null],["info",2,"h1"],["warn",5,null]]}`
+	if string(got) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	if _, err := mergeData(context.Background(), [][]byte{[]byte(`{"columns":["a"],"rows":[[1,2]]}`)}, JSON, Table); err == nil {
+		t.Error("expected error for row not matching its columns")
+	}
+
+	var s MergeStrategy
+	if err := s.UnmarshalText([]byte("table")); err != nil || s != Table {
+		t.Errorf("UnmarshalText(table) = %v, %v", s, err)
+	}
+}
+
+func TestMergeData_sumFirstSeenOrder(t *testing.T) {
+	data := [][]byte{
+		[]byte(`{"values":[{"value":"z","hits":1},{"value":"b","hits":1}]}`),
+		[]byte(`{"values":[{"value":"m","hits":1},{"value":"z","hits":2}]}`),
+		[]byte(`{"values":[{"value":"a","hits":1},{"value":"b","hits":3}]}`),
+	}
+	want := `{"values":[{"hits":3,"value":"z"},{"hits":4,"value":"b"},{"hits":1,"value":"m"},{"hits":1,"value":"a"}]}`
+	for _, workers := range []int{1, 4} {
+		setOpts(t, func(o *Options) { o.MergeWorkers = workers })
+		got, err := mergeData(context.Background(), data, JSON, Sum)
+		if err != nil {
+			t.Fatalf("mergeData() failed: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("%d workers: got %s, want %s", workers, got, want)
+		}
+	}
+}
+
+func TestOrderKeys(t *testing.T) {
+	responses := [][]byte{
+		[]byte(`{"z":1,"a":{"y":1,"b":2},"list":[{"k2":1,"k1":2}]}`),
+		[]byte(`{"m":1,"a":{"c":1},"list":[{"k3":1,"k1":1}]}`),
+	}
+	merged, err := mergeData(context.Background(), responses, JSON, Merge)
+	if err != nil {
+		t.Fatalf("mergeData() failed: %v", err)
+	}
+	if want := `{"a":{"b":2,"c":1,"y":1},"list":[{"k1":2,"k2":1},{"k1":1,"k3":1}],"m":1,"z":1}`; string(merged) != want {
+		t.Fatalf("merge without key order: got %s, want %s", merged, want)
+	}
+
+	got, err := orderKeys(merged, responses)
+	if err != nil {
+		t.Fatalf("orderKeys() failed: %v", err)
+	}
+	if want := `{"z":1,"a":{"y":1,"b":2,"c":1},"list":[{"k2":1,"k1":2},{"k1":1,"k3":1}],"m":1}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// keys of no response, e.g. from a transform, follow sorted
+	got, err = orderKeys([]byte(`{"new2":1,"m":1,"new1":1,"z":1.50}`), responses)
+	if err != nil {
+		t.Fatalf("orderKeys() failed: %v", err)
+	}
+	if want := `{"z":1.50,"m":1,"new1":1,"new2":1}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
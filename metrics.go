@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backendMetrics collects the metrics of backend requests served on /metrics.
+var backendMetrics = &metrics{}
+
+type metricKey struct {
+	path     string
+	endpoint string
+}
+
+type metricValues struct {
+	requests    uint64
+	errors      uint64
+	durationSum float64
+}
+
+type metrics struct {
+	mu     sync.Mutex
+	values map[metricKey]*metricValues
+}
+
+// endpointLabel returns the value of the endpoint label according to
+// -metricsEndpointLabel: the URL, nothing, or a hash bucket of the URL to
+// bound the cardinality in large deployments.
+func endpointLabel(ep Endpoint) string {
+	switch opts.MetricsEndpointLabel {
+	case "none":
+		return ""
+	case "hash":
+		h := fnv.New32a()
+		_, _ = io.WriteString(h, ep.URL)
+		return "bucket-" + strconv.Itoa(int(h.Sum32()%uint32(opts.MetricsHashBuckets)))
+	default:
+		return redactURL(ep.URL)
+	}
+}
+
+// parseMetricsEndpointLabel parses the -metricsEndpointLabel flag.
+func parseMetricsEndpointLabel(s string) error {
+	if mode, n, ok := strings.Cut(s, ":"); ok && mode == "hash" {
+		buckets, err := strconv.Atoi(n)
+		if err != nil || buckets < 1 {
+			return fmt.Errorf("invalid number of hash buckets %q", n)
+		}
+		opts.MetricsEndpointLabel, opts.MetricsHashBuckets = "hash", buckets
+		return nil
+	}
+	if s != "url" && s != "none" {
+		return fmt.Errorf("use url, none or hash:<buckets>")
+	}
+	opts.MetricsEndpointLabel = s
+	return nil
+}
+
+func (m *metrics) observe(path string, ep Endpoint, d time.Duration, failed bool) {
+	key := metricKey{path: path, endpoint: endpointLabel(ep)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = map[metricKey]*metricValues{}
+	}
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValues{}
+		m.values[key] = v
+	}
+	v.requests++
+	v.durationSum += d.Seconds()
+	if failed {
+		v.errors++
+	}
+}
+
+// labels formats the label set of key, leaving out an empty endpoint.
+func (k metricKey) labels() string {
+	if k.endpoint == "" {
+		return fmt.Sprintf(`{path=%q}`, k.path)
+	}
+	return fmt.Sprintf(`{path=%q,endpoint=%q}`, k.path, k.endpoint)
+}
+
+// writeTo writes the metrics in the Prometheus text format.
+func (m *metrics) writeTo(w io.Writer, endpoints []Endpoint) error {
+	m.mu.Lock()
+	keys := make([]metricKey, 0, len(m.values))
+	values := make(map[metricKey]metricValues, len(m.values))
+	for k, v := range m.values {
+		keys = append(keys, k)
+		values[k] = *v
+	}
+	m.mu.Unlock()
+
+	slices.SortFunc(keys, func(a, b metricKey) int {
+		if c := strings.Compare(a.path, b.path); c != 0 {
+			return c
+		}
+		return strings.Compare(a.endpoint, b.endpoint)
+	})
+
+	var b strings.Builder
+	b.WriteString("# TYPE vlmultiselect_backend_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "vlmultiselect_backend_requests_total%s %d\n", k.labels(), values[k].requests)
+	}
+	b.WriteString("# TYPE vlmultiselect_backend_errors_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "vlmultiselect_backend_errors_total%s %d\n", k.labels(), values[k].errors)
+	}
+	b.WriteString("# TYPE vlmultiselect_backend_request_duration_seconds summary\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "vlmultiselect_backend_request_duration_seconds_sum%s %g\n", k.labels(), values[k].durationSum)
+		fmt.Fprintf(&b, "vlmultiselect_backend_request_duration_seconds_count%s %d\n", k.labels(), values[k].requests)
+	}
+
+	open := map[string]int{}
+	var labels []string
+	for _, ep := range endpoints {
+		label := endpointLabel(ep)
+		if _, ok := open[label]; !ok {
+			labels = append(labels, label)
+			open[label] = 0
+		}
+		if endpointHealth.breaker(ep) != breakerClosed {
+			open[label]++
+		}
+	}
+	b.WriteString("# TYPE vlmultiselect_breakers_open gauge\n")
+	for _, label := range labels {
+		if label == "" {
+			fmt.Fprintf(&b, "vlmultiselect_breakers_open %d\n", open[label])
+			continue
+		}
+		fmt.Fprintf(&b, "vlmultiselect_breakers_open{endpoint=%q} %d\n", label, open[label])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func metricsHandler(endpoints []Endpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := backendMetrics.writeTo(w, endpoints); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_endpointLabel(t *testing.T) {
+	var endpoints []Endpoint
+	for range 3 {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, `{}`)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	tests := []struct {
+		flag       string
+		wantLabels func(labels []string) bool
+	}{
+		{"url", func(labels []string) bool {
+			return len(labels) == 3 && slices.Contains(labels, endpoints[0].URL)
+		}},
+		{"none", func(labels []string) bool { return len(labels) == 0 }},
+		{"hash:1", func(labels []string) bool { return slices.Equal(labels, []string{"bucket-0"}) }},
+	}
+
+	defer func(m *metrics) { backendMetrics = m }(backendMetrics)
+	labelRe := regexp.MustCompile(`vlmultiselect_backend_requests_total\{path="[^"]+"(?:,endpoint="([^"]+)")?\}`)
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) {
+			if err := parseMetricsEndpointLabel(tt.flag); err != nil {
+				t.Fatalf("parseMetricsEndpointLabel(%q) failed: %v", tt.flag, err)
+			}
+		})
+		backendMetrics = &metrics{}
+
+		handler := makeJSONHandler(Route{Path: "/select/logsql/streams", Format: JSON, MergeStrategy: Merge}, endpoints)
+		for range 2 {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/select/logsql/streams", bytes.NewBuffer([]byte("query=*"))))
+		}
+
+		rr := httptest.NewRecorder()
+		metricsHandler(endpoints).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+		var labels []string
+		for _, m := range labelRe.FindAllStringSubmatch(rr.Body.String(), -1) {
+			if m[1] != "" {
+				labels = append(labels, m[1])
+			}
+		}
+		if !tt.wantLabels(labels) {
+			t.Errorf("%s: unexpected endpoint labels %v\n%s", tt.flag, labels, rr.Body.String())
+		}
+		if !strings.Contains(rr.Body.String(), "vlmultiselect_breakers_open") {
+			t.Errorf("%s: breaker metric missing", tt.flag)
+		}
+		if tt.flag == "none" && !strings.Contains(rr.Body.String(), `vlmultiselect_backend_requests_total{path="/select/logsql/streams"} 6`) {
+			t.Errorf("expected aggregated request count:\n%s", rr.Body.String())
+		}
+	}
+
+	for _, invalid := range []string{"host", "hash:0", "hash:x"} {
+		if err := parseMetricsEndpointLabel(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
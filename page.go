@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// page is an offset+limit window over the lines of a merged NDJSON response.
+type page struct {
+	offset int
+	limit  int
+}
+
+// takePage reads the _offset and _limit query parameters, which are not
+// forwarded. ok is false if neither is set.
+func takePage(r *http.Request) (p page, ok bool, err error) {
+	offsets := takeQueryParam(r, "_offset")
+	limits := takeQueryParam(r, "_limit")
+	if len(offsets) == 0 && len(limits) == 0 {
+		return p, false, nil
+	}
+	if len(offsets) > 0 {
+		if p.offset, err = strconv.Atoi(offsets[len(offsets)-1]); err != nil || p.offset < 0 {
+			return p, false, fmt.Errorf("invalid _offset %q", offsets[len(offsets)-1])
+		}
+	}
+	if len(limits) > 0 {
+		if p.limit, err = strconv.Atoi(limits[len(limits)-1]); err != nil || p.limit <= 0 {
+			return p, false, fmt.Errorf("invalid _limit %q", limits[len(limits)-1])
+		}
+	}
+	return p, true, nil
+}
+
+// apply returns the lines of the page and the offset of the next page, or -1
+// if there are no more lines. A zero limit returns all lines from offset.
+func (p page) apply(b []byte) ([]byte, int) {
+	start := 0
+	for range p.offset {
+		i := bytes.IndexByte(b[start:], '\n')
+		if i < 0 {
+			return nil, -1
+		}
+		start += i + 1
+	}
+	if p.limit == 0 {
+		return b[start:], -1
+	}
+	end := start
+	for range p.limit {
+		i := bytes.IndexByte(b[end:], '\n')
+		if i < 0 {
+			return b[start:], -1
+		}
+		end += i + 1
+	}
+	if end == len(b) {
+		return b[start:end], -1
+	}
+	return b[start:end], p.offset + p.limit
+}
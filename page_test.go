@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMakeJSONHandler_pagination(t *testing.T) {
+	var endpoints []Endpoint
+	var all []string
+	for node := range 2 {
+		var lines []string
+		for i := range 5 {
+			lines = append(lines, fmt.Sprintf(`{"node":%d,"i":%d}`, node, i))
+		}
+		all = append(all, lines...)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.RawQuery, "_offset") || strings.Contains(r.URL.RawQuery, "_limit") {
+				t.Errorf("paging parameters forwarded: %s", r.URL.RawQuery)
+			}
+			_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: strconv.Itoa(node), ProjectID: "p", URL: server.URL})
+	}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	var got []string
+	offset, pages := "0", 0
+	for offset != "" {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?_offset="+offset+"&_limit=3", bytes.NewBuffer([]byte("query=*"))))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("offset %s: expected 200, got %d: %s", offset, rr.Code, rr.Body.String())
+		}
+		page := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+		if len(page) > 3 {
+			t.Errorf("offset %s: got %d lines, want at most 3", offset, len(page))
+		}
+		got = append(got, page...)
+		offset = rr.Header().Get("X-VLMultiselect-Next-Offset")
+		if pages++; pages > 10 {
+			t.Fatal("pagination does not end")
+		}
+	}
+	if pages != 4 {
+		t.Errorf("expected 4 pages, got %d", pages)
+	}
+	if strings.Join(got, "\n") != strings.Join(all, "\n") {
+		t.Errorf("pages have gaps or overlap:\ngot  %q\nwant %q", got, all)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?_offset=20&_limit=3", bytes.NewBuffer([]byte("query=*"))))
+	if rr.Body.Len() != 0 || rr.Header().Get("X-VLMultiselect-Next-Offset") != "" {
+		t.Errorf("expected empty last page, got %q", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query?_limit=-1", bytes.NewBuffer([]byte("query=*"))))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid _limit, got %d", rr.Code)
+	}
+}
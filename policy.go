@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// ErrorPolicy controls how a failed endpoint affects the merged response.
+type ErrorPolicy int
+
+const (
+	// Fail rejects the whole request if any endpoint fails.
+	Fail ErrorPolicy = iota
+	// Skip leaves failed endpoints out of the merge.
+	Skip
+	// Include merges the successful endpoints and reports the failed ones
+	// in the response.
+	Include
+)
+
+var errorPolicyNames = map[ErrorPolicy]string{
+	Fail:    "fail",
+	Skip:    "skip",
+	Include: "include",
+}
+
+func (p ErrorPolicy) String() string {
+	return errorPolicyNames[p]
+}
+
+// Set implements flag.Value.
+func (p *ErrorPolicy) Set(s string) error {
+	for policy, name := range errorPolicyNames {
+		if name == s {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown error policy %q, use fail, skip or include", s)
+}
+
+// endpointError is the representation of a failed endpoint in the response.
+type endpointError struct {
+	URL        string `json:"url"`
+	AccountID  string `json:"accountID"`
+	ProjectID  string `json:"projectID"`
+	StatusCode int    `json:"status,omitempty"`
+	Error      string `json:"error"`
+}
+
+func errorPolicyFor(format Format) ErrorPolicy {
+	if format == NDJSON {
+		return opts.NDJSONErrorPolicy
+	}
+	return opts.JSONErrorPolicy
+}
+
+// backendError is a response of the backends passed on to the client as-is.
+type backendError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *backendError) Error() string {
+	return string(e.Body)
+}
+
+// commonQueryError returns a backendError if every endpoint rejected the
+// request with 400 and the same body, as VictoriaLogs does for LogsQL syntax
+// errors. The client gets that body instead of an error policy result.
+func commonQueryError(results []endpointResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	body := bytes.TrimSpace(results[0].Body)
+	for _, res := range results {
+		if res.StatusCode != http.StatusBadRequest || !bytes.Equal(bytes.TrimSpace(res.Body), body) {
+			return nil
+		}
+	}
+	return &backendError{StatusCode: http.StatusBadRequest, Body: results[0].Body}
+}
+
+// collectResults applies the error policy of the format to the endpoint
+// results. It returns the bodies to merge and, for the Include policy, the
+// endpoints that failed.
+func collectResults(results []endpointResult, format Format) ([][]byte, []endpointResult, error) {
+	policy := errorPolicyFor(format)
+
+	var (
+		data   [][]byte
+		failed []endpointResult
+	)
+	for _, res := range results {
+		if res.Err == nil {
+			// e.g. 204, there is nothing to merge
+			if len(bytes.TrimSpace(res.Body)) > 0 {
+				data = append(data, res.Body)
+			}
+			continue
+		}
+
+		switch policy {
+		case Fail:
+			return nil, nil, res.Err
+		case Skip:
+			log.Printf("warning: skipping endpoint %s (%s:%s): %v", res.Endpoint.URL, res.Endpoint.AccountID, res.Endpoint.ProjectID, res.Err)
+		case Include:
+			failed = append(failed, res)
+		}
+	}
+	return data, failed, nil
+}
+
+// appendErrors adds the failed endpoints to the merged response. NDJSON gets
+// one error line per endpoint, JSON gets an "errors" array at the top level
+// or, for array-rooted responses, one error element per endpoint.
+func appendErrors(merged []byte, format Format, failed []endpointResult) ([]byte, error) {
+	if len(failed) == 0 {
+		return merged, nil
+	}
+
+	errs := make([]endpointError, 0, len(failed))
+	for _, res := range failed {
+		errs = append(errs, endpointError{
+			URL:        res.Endpoint.URL,
+			AccountID:  res.Endpoint.AccountID,
+			ProjectID:  res.Endpoint.ProjectID,
+			StatusCode: res.StatusCode,
+			Error:      res.Err.Error(),
+		})
+	}
+
+	switch format {
+	case NDJSON:
+		buf := bytes.NewBuffer(merged)
+		enc := json.NewEncoder(buf)
+		for _, e := range errs {
+			if err := enc.Encode(map[string]endpointError{"_error": e}); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+
+	case JSON:
+		if isArrayRooted(merged) {
+			items := make([]any, 0, len(errs))
+			for _, e := range errs {
+				items = append(items, map[string]endpointError{"_error": e})
+			}
+			raw, err := json.Marshal(items)
+			if err != nil {
+				return nil, err
+			}
+			return concatJSONArrays([][]byte{merged, raw})
+		}
+
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(merged, &obj); err != nil {
+			return nil, fmt.Errorf("failed to add errors to response: %w", err)
+		}
+		raw, err := json.Marshal(errs)
+		if err != nil {
+			return nil, err
+		}
+		obj["errors"] = raw
+		return json.Marshal(obj)
+
+	default:
+		return nil, fmt.Errorf("unsupported format: %d", format)
+	}
+}
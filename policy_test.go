@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorPolicy(t *testing.T) {
+	tests := []struct {
+		policy  ErrorPolicy
+		format  Format
+		wantErr bool
+		want    string
+	}{
+		{Fail, JSON, true, ""},
+		{Skip, JSON, false, `{"a":1}`},
+		{Include, JSON, false, `{"a":1,"errors":[{"url":"BAD","accountID":"2","projectID":"p2","status":500,"error":"boom"}]}`},
+		{Fail, NDJSON, true, ""},
+		{Skip, NDJSON, false, `{"a":1}` + "\n"},
+		{Include, NDJSON, false, `{"a":1}` + "\n" + `{"_error":{"url":"BAD","accountID":"2","projectID":"p2","status":500,"error":"boom"}}` + "\n"},
+	}
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"a":1}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer good.Close()
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, err := io.WriteString(w, "boom")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer bad.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: good.URL},
+		{AccountID: "2", ProjectID: "p2", URL: bad.URL},
+	}
+
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) {
+			o.JSONErrorPolicy = tt.policy
+			o.NDJSONErrorPolicy = tt.policy
+		})
+
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		rr := httptest.NewRecorder()
+		makeJSONHandler(Route{Path: "/select/logsql/query", Format: tt.format, MergeStrategy: Merge}, endpoints).ServeHTTP(rr, req)
+
+		if tt.wantErr {
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s/%d: expected status 400, got %d", tt.policy, tt.format, rr.Code)
+			}
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s/%d: expected status 200, got %d: %s", tt.policy, tt.format, rr.Code, rr.Body.String())
+			continue
+		}
+
+		got := strings.ReplaceAll(rr.Body.String(), bad.URL, "BAD")
+		if tt.format == JSON {
+			var gotObj, wantObj any
+			if err := json.Unmarshal([]byte(got), &gotObj); err != nil {
+				t.Fatalf("json.Unmarshal(got) failed: %v\nraw: %s", err, got)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantObj); err != nil {
+				t.Fatalf("json.Unmarshal(want) failed: %v", err)
+			}
+			got, tt.want = toJSON(t, gotObj), toJSON(t, wantObj)
+		}
+		if got != tt.want {
+			t.Errorf("%s/%d: got %q, want %q", tt.policy, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestErrorPolicySet(t *testing.T) {
+	var p ErrorPolicy
+	if err := p.Set("include"); err != nil || p != Include {
+		t.Errorf("Set(include) = %v, policy %s", err, p)
+	}
+	if err := p.Set("ignore"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func toJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	return string(b)
+}
+
+func TestMakeJSONHandler_queryErrorPassthrough(t *testing.T) {
+	const parseError = `cannot parse query [foo:(]: missing ')'`
+	newServer := func(status int, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+	a := newServer(http.StatusBadRequest, parseError+"\n")
+	defer a.Close()
+	b := newServer(http.StatusBadRequest, parseError)
+	defer b.Close()
+	other := newServer(http.StatusBadRequest, "unknown tenant")
+	defer other.Close()
+
+	route := Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}
+	for _, policy := range []ErrorPolicy{Fail, Skip, Include} {
+		setOpts(t, func(o *Options) { o.NDJSONErrorPolicy = policy })
+
+		handler := makeJSONHandler(route, []Endpoint{
+			{AccountID: "1", ProjectID: "p1", URL: a.URL},
+			{AccountID: "2", ProjectID: "p2", URL: b.URL},
+		})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBufferString("query=foo:(")))
+		if rr.Code != http.StatusBadRequest || rr.Body.String() != parseError+"\n" {
+			t.Errorf("%s: got %d %q, want 400 with the parse error", policy, rr.Code, rr.Body.String())
+		}
+	}
+
+	// differing bodies are handled by the error policy
+	setOpts(t, func(o *Options) { o.NDJSONErrorPolicy = Skip })
+	handler := makeJSONHandler(route, []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: a.URL},
+		{AccountID: "2", ProjectID: "p2", URL: other.URL},
+	})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBufferString("query=foo:(")))
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("skip with differing errors: got %d %q, want empty 200", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMakeJSONHandler_singleEndpointPassthrough(t *testing.T) {
+	newServer := func(status int, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+	notFound := newServer(http.StatusNotFound, "404 page not found\n")
+	defer notFound.Close()
+	ok := newServer(http.StatusOK, `{"values":[{"value":"A","hits":1}],"extra":true}`)
+	defer ok.Close()
+
+	// the error policy would turn a 404 into 200 or 400 if there were anything to merge
+	for _, policy := range []ErrorPolicy{Fail, Skip, Include} {
+		setOpts(t, func(o *Options) { o.NDJSONErrorPolicy = policy })
+		handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge},
+			[]Endpoint{{AccountID: "1", ProjectID: "p1", URL: notFound.URL}})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBufferString("query=*")))
+		if rr.Code != http.StatusNotFound || rr.Body.String() != "404 page not found\n" {
+			t.Errorf("%s: got %d %q, want the backend 404", policy, rr.Code, rr.Body.String())
+		}
+	}
+
+	// the body is not merged, so keys the sum strategy drops are kept
+	handler := makeJSONHandler(Route{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: Sum},
+		[]Endpoint{{AccountID: "1", ProjectID: "p1", URL: ok.URL}})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/field_values", bytes.NewBufferString("query=*")))
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"values":[{"value":"A","hits":1}],"extra":true}` {
+		t.Errorf("got %d %q, want the unmodified backend response", rr.Code, rr.Body.String())
+	}
+
+	// two endpoints are merged as before
+	setOpts(t, func(o *Options) { o.NDJSONErrorPolicy = Skip })
+	handler = makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge},
+		[]Endpoint{{AccountID: "1", ProjectID: "p1", URL: notFound.URL}, {AccountID: "2", ProjectID: "p2", URL: notFound.URL}})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBufferString("query=*")))
+	if rr.Code != http.StatusOK {
+		t.Errorf("two endpoints: got %d, want 200 from the skip policy", rr.Code)
+	}
+}
+
+func TestMakeJSONHandler_emptyResults(t *testing.T) {
+	newServer := func(status int, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+	noContent := newServer(http.StatusNoContent, "")
+	defer noContent.Close()
+	notFound := newServer(http.StatusNotFound, "404 page not found\n")
+	defer notFound.Close()
+	ndjson := newServer(http.StatusOK, `{"_msg":"a"}`+"\n")
+	defer ndjson.Close()
+	object := newServer(http.StatusOK, `{"values":[{"value":"A","hits":1}]}`)
+	defer object.Close()
+
+	tests := []struct {
+		comment  string
+		notFound bool
+		empty    string
+		route    Route
+		data     string
+		wantCode int
+		want     string
+	}{
+		{"ndjson 204", false, noContent.URL, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, ndjson.URL,
+			http.StatusOK, `{"_msg":"a"}` + "\n"},
+		{"json 204", false, noContent.URL, Route{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: Sum}, object.URL,
+			http.StatusOK, `{"values":[{"hits":1,"value":"A"}]}`},
+		{"404 fails by default", false, notFound.URL, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, ndjson.URL,
+			http.StatusBadRequest, "404 page not found\n\n"},
+		{"404 with -notFoundAsEmpty", true, notFound.URL, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, ndjson.URL,
+			http.StatusOK, `{"_msg":"a"}` + "\n"},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.NotFoundAsEmpty = tt.notFound })
+		handler := makeJSONHandler(tt.route, []Endpoint{
+			{AccountID: "1", ProjectID: "p1", URL: tt.empty},
+			{AccountID: "2", ProjectID: "p2", URL: tt.data},
+		})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", tt.route.Path, bytes.NewBufferString("query=*")))
+		if rr.Code != tt.wantCode || rr.Body.String() != tt.want {
+			t.Errorf("%s: got %d %q, want %d %q", tt.comment, rr.Code, rr.Body.String(), tt.wantCode, tt.want)
+		}
+	}
+
+	// a single endpoint without data gets the empty result of the strategy
+	for strategy, want := range map[MergeStrategy]string{Sum: `{"values":[]}`, Merge: `{}`} {
+		route := Route{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: strategy}
+		rr := httptest.NewRecorder()
+		makeJSONHandler(route, []Endpoint{{AccountID: "1", ProjectID: "p1", URL: noContent.URL}}).
+			ServeHTTP(rr, httptest.NewRequest("POST", route.Path, bytes.NewBufferString("query=*")))
+		if rr.Code != http.StatusOK || rr.Body.String() != want {
+			t.Errorf("single endpoint 204 with %s: got %d %q, want 200 %q", strategy, rr.Code, rr.Body.String(), want)
+		}
+	}
+}
+
+func TestMakeJSONHandler_errorKey(t *testing.T) {
+	newServer := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+	}
+	good := newServer(`{"values":[{"value":"A","hits":1}]}`)
+	defer good.Close()
+	broken := newServer(`{"error":"no such tenant"}`)
+	defer broken.Close()
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: good.URL},
+		{AccountID: "2", ProjectID: "p2", URL: broken.URL},
+	}
+	route := Route{Path: "/select/logsql/field_values", Format: JSON, MergeStrategy: Merge}
+
+	tests := []struct {
+		errorKey string
+		policy   ErrorPolicy
+		wantCode int
+		want     string
+	}{
+		{"", Fail, http.StatusOK, `{"error":"no such tenant","values":[{"hits":1,"value":"A"}]}`},
+		{"error", Fail, http.StatusBadRequest, "endpoint reported error: no such tenant\n"},
+		{"error", Skip, http.StatusOK, `{"values":[{"hits":1,"value":"A"}]}`},
+		{"error", Include, http.StatusOK, `{"errors":[{"accountID":"2","error":"endpoint reported error: no such tenant","projectID":"p2","status":200,"url":"BROKEN"}],"values":[{"hits":1,"value":"A"}]}`},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) {
+			o.ErrorKey = tt.errorKey
+			o.JSONErrorPolicy = tt.policy
+		})
+		rr := httptest.NewRecorder()
+		makeJSONHandler(route, endpoints).ServeHTTP(rr, httptest.NewRequest("POST", route.Path, bytes.NewBufferString("query=*")))
+
+		got := strings.ReplaceAll(rr.Body.String(), broken.URL, "BROKEN")
+		if tt.wantCode == http.StatusOK {
+			var obj any
+			if err := json.Unmarshal([]byte(got), &obj); err != nil {
+				t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, got)
+			}
+			got = toJSON(t, obj)
+		}
+		if rr.Code != tt.wantCode || got != tt.want {
+			t.Errorf("%q/%s: got %d %q, want %d %q", tt.errorKey, tt.policy, rr.Code, got, tt.wantCode, tt.want)
+		}
+	}
+
+	// a single endpoint is passed through, but not with an error in its body
+	setOpts(t, func(o *Options) {
+		o.ErrorKey = "error"
+		o.JSONErrorPolicy = Fail
+	})
+	rr := httptest.NewRecorder()
+	makeJSONHandler(route, endpoints[1:]).ServeHTTP(rr, httptest.NewRequest("POST", route.Path, bytes.NewBufferString("query=*")))
+	if want := "endpoint reported error: no such tenant\n"; rr.Code != http.StatusBadRequest || rr.Body.String() != want {
+		t.Errorf("single endpoint: got %d %q, want %d %q", rr.Code, rr.Body.String(), http.StatusBadRequest, want)
+	}
+}
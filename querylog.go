@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// queryLog records incoming queries if -queryLog is set.
+var queryLog *queryLogger
+
+// queryLogEntry is a single line in the query log.
+type queryLogEntry struct {
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Params  string    `json:"params"`
+	Body    string    `json:"body"`
+	Tenants []string  `json:"tenants"`
+}
+
+// queryLogger appends JSON lines to a file and rotates it to <path>.1 once
+// it grows beyond maxSize bytes. A maxSize of 0 disables rotation.
+type queryLogger struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func newQueryLogger(path string, maxSize int64) (*queryLogger, error) {
+	l := &queryLogger{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *queryLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open query log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat query log: %w", err)
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+func (l *queryLogger) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Record writes the entry to the query log.
+func (l *queryLogger) Record(e queryLogEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate query log: %w", err)
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Close closes the underlying file.
+func (l *queryLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// tenantsOf returns the distinct <accountID>:<projectID> pairs of endpoints.
+func tenantsOf(endpoints []Endpoint) []string {
+	var tenants []string
+	seen := map[string]bool{}
+	for _, ep := range endpoints {
+		t := ep.AccountID + ":" + ep.ProjectID
+		if !seen[t] {
+			seen[t] = true
+			tenants = append(tenants, t)
+		}
+	}
+	return tenants
+}
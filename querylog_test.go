@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	l, err := newQueryLogger(path, 0)
+	if err != nil {
+		t.Fatalf("newQueryLogger() failed: %v", err)
+	}
+	defer func(q *queryLogger) { queryLog = q }(queryLog)
+	queryLog = l
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"k":"v"}`+"\n")
+		if err != nil {
+			t.Fatalf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "2", ProjectID: "p2", URL: server.URL},
+	}
+	req := httptest.NewRequest("POST", "/select/logsql/query?limit=5", bytes.NewBuffer([]byte("query=error")))
+	if _, err := getEndpointData(req, "/select/logsql/query", endpoints); err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading query log failed: %v", err)
+	}
+	var entry queryLogEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, raw)
+	}
+	if entry.Path != "/select/logsql/query" || entry.Params != "limit=5" || entry.Body != "query=error" {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	if strings.Join(entry.Tenants, ",") != "1:p1,2:p2" {
+		t.Errorf("unexpected tenants: %v", entry.Tenants)
+	}
+	if entry.Time.IsZero() {
+		t.Error("expected timestamp to be set")
+	}
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	l, err := newQueryLogger(path, 150)
+	if err != nil {
+		t.Fatalf("newQueryLogger() failed: %v", err)
+	}
+	defer func() {
+		if err := l.Close(); err != nil {
+			t.Errorf("Close() failed: %v", err)
+		}
+	}()
+
+	for range 3 {
+		if err := l.Record(queryLogEntry{Path: "/select/logsql/query", Body: "query=*"}); err != nil {
+			t.Fatalf("Record() failed: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected rotated file: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat query log failed: %v", err)
+	}
+	if info.Size() > 150 {
+		t.Errorf("expected query log to stay below 150 bytes, got %d", info.Size())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Resolver decides the merged value of a top-level key present in more than
+// one endpoint response.
+type Resolver int
+
+const (
+	// ResolveFirst keeps the value of the first endpoint.
+	ResolveFirst Resolver = iota
+	// ResolveLast keeps the value of the last endpoint.
+	ResolveLast
+	// ResolveMax keeps the largest number.
+	ResolveMax
+	// ResolveMin keeps the smallest number.
+	ResolveMin
+	// ResolveSum adds the numbers of all endpoints.
+	ResolveSum
+	// ResolveOr is true if any endpoint reported true, e.g. for "truncated".
+	ResolveOr
+	// ResolveAnd is true only if every endpoint reported true.
+	ResolveAnd
+)
+
+var resolverNames = map[Resolver]string{
+	ResolveFirst: "first",
+	ResolveLast:  "last",
+	ResolveMax:   "max",
+	ResolveMin:   "min",
+	ResolveSum:   "sum",
+	ResolveOr:    "or",
+	ResolveAnd:   "and",
+}
+
+func (r Resolver) String() string {
+	return resolverNames[r]
+}
+
+func (r *Resolver) UnmarshalText(text []byte) error {
+	for resolver, name := range resolverNames {
+		if name == string(text) {
+			*r = resolver
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown resolver %q, use one of first, last, max, min, sum, or, and", text)
+}
+
+// resolveKeys overwrites the keys of the merged object with the value chosen
+// by their resolver from the endpoint responses in data. Keys missing in
+// every response are left alone.
+func resolveKeys(merged []byte, data [][]byte, resolvers map[string]Resolver) ([]byte, error) {
+	var out map[string]json.RawMessage
+	if err := json.Unmarshal(merged, &out); err != nil {
+		return nil, fmt.Errorf("resolve: unmarshal merged: %w", err)
+	}
+	objs := make([]map[string]json.RawMessage, 0, len(data))
+	for _, b := range data {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(b, &obj); err != nil {
+			return nil, fmt.Errorf("resolve: unmarshal: %w", err)
+		}
+		objs = append(objs, obj)
+	}
+
+	for key, resolver := range resolvers {
+		var values []json.RawMessage
+		for _, obj := range objs {
+			if v, ok := obj[key]; ok {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		v, err := resolve(resolver, values)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s of %q: %w", resolver, key, err)
+		}
+		out[key] = v
+	}
+	return json.Marshal(out)
+}
+
+func resolve(resolver Resolver, values []json.RawMessage) (json.RawMessage, error) {
+	switch resolver {
+	case ResolveFirst:
+		return values[0], nil
+	case ResolveLast:
+		return values[len(values)-1], nil
+	case ResolveOr, ResolveAnd:
+		result := resolver == ResolveAnd
+		for _, v := range values {
+			var b bool
+			if err := json.Unmarshal(v, &b); err != nil {
+				return nil, fmt.Errorf("%s is not a boolean", v)
+			}
+			if resolver == ResolveOr {
+				result = result || b
+			} else {
+				result = result && b
+			}
+		}
+		return json.Marshal(result)
+	}
+
+	nums := make([]json.Number, 0, len(values))
+	for _, v := range values {
+		n, ok := decodeNumber(v)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a number", v)
+		}
+		nums = append(nums, n)
+	}
+
+	best := nums[0]
+	if resolver == ResolveSum {
+		// a number of a single endpoint is formatted like a sum
+		best = formatNumber(string(best))
+	}
+	for _, n := range nums[1:] {
+		switch resolver {
+		case ResolveSum:
+			best = addNumbers(best, n)
+		case ResolveMax:
+			if compareNumbers(n, best) > 0 {
+				best = n
+			}
+		case ResolveMin:
+			if compareNumbers(n, best) < 0 {
+				best = n
+			}
+		}
+	}
+	return json.RawMessage(best), nil
+}
+
+func decodeNumber(raw json.RawMessage) (json.Number, bool) {
+	v, err := decodeJSON(raw)
+	if err != nil {
+		return "", false
+	}
+	n, ok := v.(json.Number)
+	return n, ok
+}
+
+// compareNumbers compares a and b as integers if both are integers, so large
+// values keep their precision, and as floats otherwise.
+func compareNumbers(a, b json.Number) int {
+	ia, errA := a.Int64()
+	ib, errB := b.Int64()
+	if errA == nil && errB == nil {
+		switch {
+		case ia < ib:
+			return -1
+		case ia > ib:
+			return 1
+		}
+		return 0
+	}
+	fa, _ := a.Float64()
+	fb, _ := b.Float64()
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	}
+	return 0
+}
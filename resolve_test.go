@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveKeys(t *testing.T) {
+	data := [][]byte{
+		[]byte(`{"total":3,"maxTime":100,"name":"a","nested":{"x":1}}`),
+		[]byte(`{"total":4,"maxTime":250,"name":"b"}`),
+		[]byte(`{"total":1.5,"maxTime":20}`),
+	}
+	merged := []byte(`{"total":1.5,"maxTime":20,"name":"b","nested":{"x":1}}`)
+
+	got, err := resolveKeys(merged, data, map[string]Resolver{"total": ResolveSum, "maxTime": ResolveMax, "name": ResolveFirst})
+	if err != nil {
+		t.Fatalf("resolveKeys() failed: %v", err)
+	}
+	want := `{"maxTime":250,"name":"a","nested":{"x":1},"total":8.5}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := resolveKeys(merged, data, map[string]Resolver{"name": ResolveMin}); err == nil {
+		t.Error("expected error for min of strings")
+	}
+
+	// a single number is formatted like a sum
+	setOpts(t, func(o *Options) { o.NumberFormat = "float" })
+	got, err = resolveKeys([]byte(`{"total":2}`), [][]byte{[]byte(`{"total":2}`)}, map[string]Resolver{"total": ResolveSum})
+	if want := `{"total":2.0}`; err != nil || string(got) != want {
+		t.Errorf("-numberFormat=float: got %s, %v, want %s", got, err, want)
+	}
+}
+
+func TestForwardAndMerge_resolve(t *testing.T) {
+	var endpoints []Endpoint
+	for i, body := range []string{`{"total":3,"maxTime":100}`, `{"total":4,"maxTime":250}`, `{"total":5,"maxTime":20}`} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, body)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: fmt.Sprint(i), ProjectID: "p", URL: server.URL})
+	}
+
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/stats_query": {"resolve": {"total": "sum", "maxTime": "max"}}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	configured, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+	var route Route
+	for _, r := range configured {
+		if r.Path == "/select/logsql/stats_query" {
+			route = r
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/stats_query", bytes.NewBuffer([]byte("query=*")))
+	got, err := forwardAndMerge(req, route, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	if want := `{"maxTime":250,"total":12}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolver_UnmarshalText(t *testing.T) {
+	var r Resolver
+	if err := r.UnmarshalText([]byte("max")); err != nil || r != ResolveMax {
+		t.Errorf("got %v, %v, want max", r, err)
+	}
+	if err := r.UnmarshalText([]byte("avg")); err == nil {
+		t.Error("expected error for unknown resolver")
+	}
+}
+
+func TestForwardAndMerge_resolveBooleans(t *testing.T) {
+	var endpoints []Endpoint
+	for i, body := range []string{`{"truncated":false,"complete":true}`, `{"truncated":true,"complete":true}`, `{"truncated":false,"complete":false}`} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.WriteString(w, body); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: fmt.Sprint(i), ProjectID: "p", URL: server.URL})
+	}
+	route := Route{
+		Path:          "/select/logsql/stats_query",
+		Format:        JSON,
+		MergeStrategy: Merge,
+		Resolve:       map[string]Resolver{"truncated": ResolveOr, "complete": ResolveAnd},
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/stats_query", bytes.NewBuffer([]byte("query=*")))
+	got, err := forwardAndMerge(req, route, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	if want := `{"complete":false,"truncated":true}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := resolveKeys([]byte(`{"n":1}`), [][]byte{[]byte(`{"n":1}`)}, map[string]Resolver{"n": ResolveOr}); err == nil {
+		t.Error("expected error for or of numbers")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "sync/atomic"
+
+// retryBudget limits the retries of all endpoints of one client request, so
+// an outage of many nodes can't multiply the backend load.
+type retryBudget struct {
+	limited   bool
+	remaining atomic.Int64
+}
+
+// newRetryBudget returns a budget of n retries, unlimited for n <= 0.
+func newRetryBudget(n int) *retryBudget {
+	b := &retryBudget{limited: n > 0}
+	b.remaining.Store(int64(n))
+	return b
+}
+
+// take reports whether another retry is allowed and uses it up.
+func (b *retryBudget) take() bool {
+	if !b.limited {
+		return true
+	}
+	return b.remaining.Add(-1) >= 0
+}
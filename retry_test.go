@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetEndpointData_retryBudget(t *testing.T) {
+	var attempts atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	var endpoints []Endpoint
+	for i := range 3 {
+		endpoints = append(endpoints, Endpoint{AccountID: fmt.Sprint(i), ProjectID: "p", URL: failing.URL})
+	}
+
+	tests := []struct {
+		retries, budget int
+		want            int32
+	}{
+		{0, 0, 3},
+		{2, 0, 9},
+		{5, 4, 7},
+		{1, 10, 6},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) {
+			o.BackendRetries = tt.retries
+			o.RetryBudget = tt.budget
+		})
+		attempts.Store(0)
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+		if err != nil {
+			t.Fatalf("getEndpointData() failed: %v", err)
+		}
+		if got := attempts.Load(); got != tt.want {
+			t.Errorf("retries %d, budget %d: got %d backend requests, want %d", tt.retries, tt.budget, got, tt.want)
+		}
+		for _, res := range results {
+			if res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("expected last status 503, got %d", res.StatusCode)
+			}
+		}
+	}
+}
+
+func TestGetEndpointData_retrySucceeds(t *testing.T) {
+	setOpts(t, func(o *Options) { o.BackendRetries = 2 })
+
+	var attempts atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "query=*" {
+			t.Errorf("retry got body %q", body)
+		}
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if _, err := io.WriteString(w, `{"n":1}`+"\n"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer flaky.Close()
+	badQuery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer badQuery.Close()
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	results, err := getEndpointData(req, "/select/logsql/query", []Endpoint{{AccountID: "1", ProjectID: "p1", URL: flaky.URL}})
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	if results[0].Err != nil || attempts.Load() != 2 {
+		t.Errorf("expected success on second attempt, got %v after %d attempts", results[0].Err, attempts.Load())
+	}
+
+	// a bad query is not the endpoint's fault and is not retried
+	attempts.Store(0)
+	req = httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	if _, err := getEndpointData(req, "/select/logsql/query", []Endpoint{{AccountID: "1", ProjectID: "p1", URL: badQuery.URL}}); err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("expected no retry for 400, got %d attempts", attempts.Load())
+	}
+}
+
+func TestGetEndpointData_clientCancel(t *testing.T) {
+	setOpts(t, func(o *Options) {
+		o.BackendRetries = 3
+		o.BreakerThreshold = 1
+		o.BreakerCooldown = time.Hour
+	})
+	defer func(h *healthTracker) { endpointHealth = h }(endpointHealth)
+	endpointHealth = &healthTracker{}
+	defer func(m *metrics) { backendMetrics = m }(backendMetrics)
+	backendMetrics = &metrics{}
+
+	var attempts atomic.Int32
+	started := make(chan struct{}, 1)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		// the server only notices the client leaving once the body is read
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			t.Errorf("failed reading body: %v", err)
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	ep := Endpoint{AccountID: "1", ProjectID: "p1", URL: slow.URL}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	req := httptest.NewRequestWithContext(ctx, "POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	results, err := getEndpointData(req, "/select/logsql/query", []Endpoint{ep})
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	if !errors.Is(results[0].Err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", results[0].Err)
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("got %d backend requests, want no retry after the client left", got)
+	}
+	if state := endpointHealth.breaker(ep); state != breakerClosed {
+		t.Errorf("breaker %s after a cancelled request, want closed", state)
+	}
+	if status := endpointHealth.snapshot([]Endpoint{ep})[0]; status.Errors != 0 {
+		t.Errorf("cancelled request counted as %d errors", status.Errors)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listen opens the listener for -listenAddr. An address of the form
+// unix:/path/to/socket listens on a Unix domain socket. A stale socket file
+// left by a crashed process is removed first, the socket file is removed
+// again when the listener is closed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// shutdownOnSignal gracefully shuts srv down on SIGINT or SIGTERM, which also
+// closes its listeners, see shutdownAfter.
+func shutdownOnSignal(srv *http.Server, done chan<- struct{}) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownAfter(ctx, srv, done)
+}
+
+// shutdownAfter shuts srv down once ctx is done and closes done when the
+// in-flight requests are finished, or after 10s. Serve returns as soon as
+// the shutdown starts, so the process has to wait for done before exiting.
+func shutdownAfter(ctx context.Context, srv *http.Server, done chan<- struct{}) {
+	defer close(done)
+	<-ctx.Done()
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("warning: shutdown: %v", err)
+	}
+}
+
+// serve serves srv on ln, using TLS if -tlsCertFile and -tlsKeyFile are set.
+func serve(srv *http.Server, ln net.Listener) error {
+	if opts.TLSCertFile == "" && opts.TLSKeyFile == "" {
+		return srv.Serve(ln)
+	}
+	if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+		return fmt.Errorf("-tlsCertFile and -tlsKeyFile must be set together")
+	}
+
+	certs := &certReloader{certFile: opts.TLSCertFile, keyFile: opts.TLSKeyFile}
+	if _, err := certs.GetCertificate(nil); err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	return srv.ServeTLS(ln, "", "")
+}
+
+// recoverPanics turns a panicking handler into a 500 response and logs the
+// panic with its stack instead of dropping the connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certReloader loads the certificate from disk and reloads it whenever the
+// modification time of the cert or key file changes, so renewed
+// certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			// keep serving the old certificate while files are being replaced
+			log.Printf("warning: failed to reload TLS certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	if c.cert != nil {
+		log.Printf("reloaded TLS certificate from %s", c.certFile)
+	}
+	c.cert, c.modTime = &cert, modTime
+	return c.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
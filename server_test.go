@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 to dir
+// and returns the paths of the cert and key files.
+func writeSelfSignedCert(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshaling key failed: %v", err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("writing cert failed: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("writing key failed: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir, "server")
+	setOpts(t, func(o *Options) {
+		o.TLSCertFile = certFile
+		o.TLSKeyFile = keyFile
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
+		_, err := io.WriteString(w, "OK")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := serve(srv, ln); err != http.ErrServerClosed {
+			t.Errorf("serve() failed: %v", err)
+		}
+	}()
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Errorf("closing server failed: %v", err)
+		}
+	}()
+
+	get := func(certFile string) (string, error) {
+		pemBytes, err := os.ReadFile(certFile)
+		if err != nil {
+			t.Fatalf("reading cert failed: %v", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pemBytes)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		resp, err := client.Get("https://" + ln.Addr().String() + "/health")
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	body, err := get(certFile)
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	if body != "OK" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// replace the certificate on disk, the next handshake must use it
+	newCert, newKey := writeSelfSignedCert(t, t.TempDir(), "server")
+	for src, dst := range map[string]string{newCert: certFile, newKey: keyFile} {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatalf("reading %s failed: %v", src, err)
+		}
+		if err := os.WriteFile(dst, b, 0o600); err != nil {
+			t.Fatalf("writing %s failed: %v", dst, err)
+		}
+		future := time.Now().Add(time.Minute)
+		if err := os.Chtimes(dst, future, future); err != nil {
+			t.Fatalf("chtimes failed: %v", err)
+		}
+	}
+	if _, err := get(newCert); err != nil {
+		t.Errorf("HTTPS request with reloaded cert failed: %v", err)
+	}
+}
+
+func TestWriteTimeout_slowReader(t *testing.T) {
+	setOpts(t, func(o *Options) { o.WriteTimeout = 200 * time.Millisecond })
+
+	line := `{"_msg":"` + strings.Repeat("x", 1024) + `"}` + "\n"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, strings.Repeat(line, 32*1024))
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer backend.Close()
+
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: backend.URL}}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	done := make(chan struct{})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		close(done)
+	}))
+	defer proxy.Close()
+
+	// a client that sends a request but never reads the response
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_, err = io.WriteString(conn, "POST /select/logsql/query HTTP/1.1\r\nHost: proxy\r\nContent-Length: 7\r\n\r\nquery=*")
+	if err != nil {
+		t.Fatalf("writing request failed: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still blocked on slow client after write timeout")
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any = 42
+		_ = v.(string)
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/select/logsql/query", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rr.Code)
+	}
+}
+
+func TestGetEndpointData_recoversPanic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"n":1}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Header.Get("AccountID") == "2" {
+			panic("malformed response")
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "2", ProjectID: "p2", URL: server.URL},
+	}
+	req := httptest.NewRequest("POST", "/select/logsql/query", strings.NewReader("query=*"))
+	results, err := getEndpointData(req, "/select/logsql/query", endpoints)
+	if err != nil {
+		t.Fatalf("getEndpointData() failed: %v", err)
+	}
+	if results[0].Err != nil || string(results[0].Body) != `{"n":1}`+"\n" {
+		t.Errorf("healthy endpoint: got %q, %v", results[0].Body, results[0].Err)
+	}
+	if results[1].Err == nil || !strings.Contains(results[1].Err.Error(), "malformed response") {
+		t.Errorf("panicking endpoint: expected error, got %v", results[1].Err)
+	}
+}
+
+func TestListen_unixSocket(t *testing.T) {
+	// socket paths are limited to about 100 bytes, t.TempDir may be longer
+	dir, err := os.MkdirTemp("", "vlm")
+	if err != nil {
+		t.Fatalf("creating temp dir failed: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "vlmultiselect.sock")
+
+	// a stale socket of a crashed process must not block the listener
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen() failed: %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.WriteString(w, "OK"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	})}
+	done := make(chan error, 1)
+	go func() { done <- serve(srv, ln) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/health")
+	if err != nil {
+		t.Fatalf("request over unix socket failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "OK" {
+		t.Errorf("got %q, want OK", body)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() failed: %v", err)
+	}
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("serve() returned %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed on shutdown: %v", err)
+	}
+}
+
+func TestShutdownAfter(t *testing.T) {
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen() failed: %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		if _, err := io.WriteString(w, "OK"); err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	})}
+	served := make(chan error, 1)
+	go func() { served <- serve(srv, ln) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go shutdownAfter(ctx, srv, done)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+			body <- ""
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+
+	cancel()
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("serve() returned %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown done with a request in flight")
+	default:
+	}
+
+	close(release)
+	if got := <-body; got != "OK" {
+		t.Errorf("in-flight request got %q, want OK", got)
+	}
+	<-done
+}
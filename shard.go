@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+)
+
+// readBody reads the request body and replaces it with a copy, so it can be
+// read again when forwarding.
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to read request body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// pickEndpoint selects one endpoint for key using rendezvous hashing. The
+// same key always maps to the same endpoint, and adding or removing an
+// endpoint only moves the keys of that endpoint.
+func pickEndpoint(key []byte, endpoints []Endpoint) Endpoint {
+	var (
+		best      Endpoint
+		bestScore uint64
+	)
+	for i, ep := range endpoints {
+		h := fnv.New64a()
+		_, _ = h.Write(key)
+		_, _ = io.WriteString(h, "\x00"+ep.URL+"\x00"+ep.AccountID+":"+ep.ProjectID)
+		if score := h.Sum64(); i == 0 || score > bestScore {
+			best, bestScore = ep, score
+		}
+	}
+	return best
+}
+
+// shardEndpoint returns the endpoint that serves the request on a sharded
+// route, chosen by its path, query and body.
+func shardEndpoint(r *http.Request, path string, endpoints []Endpoint) ([]Endpoint, error) {
+	if len(endpoints) == 0 {
+		return endpoints, nil
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	key := append([]byte(path+"?"+r.URL.RawQuery+"\x00"), body...)
+	return []Endpoint{pickEndpoint(key, endpoints)}, nil
+}
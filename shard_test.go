@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPickEndpoint(t *testing.T) {
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: "http://node1"},
+		{AccountID: "1", ProjectID: "p1", URL: "http://node2"},
+		{AccountID: "1", ProjectID: "p1", URL: "http://node3"},
+	}
+
+	used := map[string]bool{}
+	for i := range 100 {
+		key := []byte(fmt.Sprintf("query=error_%d", i))
+		first := pickEndpoint(key, endpoints)
+		for range 5 {
+			if got := pickEndpoint(key, endpoints); got.String() != first.String() {
+				t.Fatalf("key %s mapped to %v and %v", key, first, got)
+			}
+		}
+		used[first.URL] = true
+
+		// removing another endpoint must not move the key
+		for j, ep := range endpoints {
+			if ep.String() == first.String() {
+				continue
+			}
+			rest := append(append([]Endpoint{}, endpoints[:j]...), endpoints[j+1:]...)
+			if got := pickEndpoint(key, rest); got.String() != first.String() {
+				t.Errorf("key %s moved from %v to %v after removing %v", key, first, got, ep)
+			}
+		}
+	}
+	if len(used) != len(endpoints) {
+		t.Errorf("expected queries to spread over all endpoints, used %v", used)
+	}
+}
+
+func TestMakeJSONHandler_shard(t *testing.T) {
+	var hits [3]atomic.Int32
+	var endpoints []Endpoint
+	for i := range hits {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+			body, _ := io.ReadAll(r.Body)
+			_, err := fmt.Fprintf(w, `{"node":%d,"body":%q}`+"\n", i, body)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge, Shard: true}, endpoints)
+
+	var first string
+	for range 3 {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*"))))
+		if first == "" {
+			first = rr.Body.String()
+		}
+		if rr.Body.String() != first {
+			t.Errorf("same query answered by different nodes: %q vs %q", first, rr.Body.String())
+		}
+	}
+
+	var total int32
+	for i := range hits {
+		total += hits[i].Load()
+	}
+	if total != 3 {
+		t.Errorf("expected one backend request per query, got %d", total)
+	}
+	if !bytes.Contains([]byte(first), []byte(`"body":"query=*"`)) {
+		t.Errorf("body not forwarded to shard: %s", first)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// requestFlights deduplicates concurrent identical requests if
+// -dedupRequests is set.
+var requestFlights singleflight.Group
+
+// doShared executes fn once for concurrent callers with the same key and
+// hands its result to all of them. fn runs with a context that is not bound
+// to any single caller, so a caller whose ctx is done returns ctx.Err() right
+// away without aborting the others. shared reports whether the result was
+// handed to more than one caller.
+func doShared(ctx context.Context, g *singleflight.Group, key string, fn func(context.Context) ([]byte, error)) (val []byte, err error, shared bool) {
+	ch := g.DoChan(key, func() (v any, err error) {
+		// DoChan re-panics outside of the handler goroutines, which crashes
+		// the process, so a panic has to be turned into an error here
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("panic in shared request: %v\n%s", p, debug.Stack())
+				v, err = nil, fmt.Errorf("internal error: %v", p)
+			}
+		}()
+		return fn(context.WithoutCancel(ctx))
+	})
+
+	select {
+	case res := <-ch:
+		val, _ := res.Val.([]byte)
+		return val, res.Err, res.Shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), false
+	}
+}
+
+// dedupRequest runs forwardAndMerge once for all concurrent requests with
+// the same path, query, body headers and body. Other forwarded headers, like
+// tracing headers, differ between requests and are taken from the first one.
+func dedupRequest(r *http.Request, route Route, endpoints []Endpoint) ([]byte, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	for _, part := range []string{route.Path, r.URL.RawQuery} {
+		_, _ = io.WriteString(h, part)
+		_, _ = h.Write([]byte{0})
+	}
+	for _, header := range bodyHeaders {
+		_, _ = io.WriteString(h, r.Header.Get(header))
+		_, _ = h.Write([]byte{0})
+	}
+	_, _ = h.Write(body)
+	key := hex.EncodeToString(h.Sum(nil))
+
+	merged, err, shared := doShared(r.Context(), &requestFlights, key, func(ctx context.Context) ([]byte, error) {
+		return forwardAndMerge(r.WithContext(ctx), route, endpoints)
+	})
+	if shared {
+		log.Printf("[REQ] shared result of identical in-flight request")
+	}
+	return merged, err
+}
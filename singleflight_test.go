@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestDedupRequests(t *testing.T) {
+	setOpts(t, func(o *Options) { o.DedupRequests = true })
+
+	var hits [2]atomic.Int32
+	var endpoints []Endpoint
+	for i := range hits {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i].Add(1)
+			time.Sleep(200 * time.Millisecond)
+			_, err := io.WriteString(w, `{"k":"v"}`+"\n")
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/select/logsql/query?limit=5", bytes.NewBuffer([]byte("query=*")))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			bodies[i] = rr.Body.String()
+		}()
+	}
+	wg.Wait()
+
+	for i := range hits {
+		if got := hits[i].Load(); got != 1 {
+			t.Errorf("endpoint %d hit %d times, want 1", i, got)
+		}
+	}
+	for i, body := range bodies {
+		if body != `{"k":"v"}`+"\n"+`{"k":"v"}`+"\n" {
+			t.Errorf("request %d got %q", i, body)
+		}
+	}
+
+	// a different body must not share the fan-out
+	req := httptest.NewRequest("POST", "/select/logsql/query?limit=5", bytes.NewBuffer([]byte("query=error")))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got := hits[0].Load(); got != 2 {
+		t.Errorf("expected a new fan-out for a different query, endpoint hit %d times", got)
+	}
+}
+
+func TestDoShared_callerCancel(t *testing.T) {
+	var g singleflight.Group
+	release := make(chan struct{})
+	started := make(chan struct{})
+	finished := make(chan error, 1)
+	fn := func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-release
+		finished <- ctx.Err()
+		return []byte("result"), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	callerErr := make(chan error, 1)
+	go func() {
+		_, err, _ := doShared(ctx, &g, "key", fn)
+		callerErr <- err
+	}()
+	<-started
+
+	// the caller leaves at once, the shared call keeps running
+	cancel()
+	if err := <-callerErr; err != context.Canceled {
+		t.Errorf("caller: expected context.Canceled, got %v", err)
+	}
+	close(release)
+	if err := <-finished; err != nil {
+		t.Errorf("shared call cancelled with its caller: %v", err)
+	}
+}
+
+func TestDoShared_panic(t *testing.T) {
+	var g singleflight.Group
+	_, err, _ := doShared(context.Background(), &g, "key", func(ctx context.Context) ([]byte, error) {
+		panic("boom")
+	})
+	if err == nil || err.Error() != "internal error: boom" {
+		t.Errorf("got %v, want the panic as error", err)
+	}
+
+	// the key is released, so the next call runs again
+	val, err, _ := doShared(context.Background(), &g, "key", func(ctx context.Context) ([]byte, error) {
+		return []byte("ok"), nil
+	})
+	if err != nil || string(val) != "ok" {
+		t.Errorf("call after panic: got %q, %v", val, err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// mergeSortedLines merges NDJSON responses that are each sorted by _time,
+// e.g. from a query ending in "| sort by (_time)", into one sorted response.
+// Lines with equal or missing _time keep their endpoint order. It stops once
+// ctx is done.
+func mergeSortedLines(ctx context.Context, data [][]byte, desc bool) ([]byte, error) {
+	sources := make([]io.Reader, len(data))
+	size := 0
+	for i, b := range data {
+		sources[i] = bytes.NewReader(b)
+		size += len(b) + 1
+	}
+	merged := bytes.NewBuffer(make([]byte, 0, size))
+	err := mergeSortedStreams(ctx, sources, desc, func(_ int, line []byte) error {
+		merged.Write(line)
+		return merged.WriteByte('\n')
+	})
+	if err != nil {
+		return nil, err
+	}
+	return merged.Bytes(), nil
+}
+
+// mergeSortedStreams passes the lines of sources that are each sorted by
+// _time to emit in sorted order, with the index of their source. It is a
+// k-way merge: only the next line of every source is read and held in a
+// heap, so the memory doesn't grow with the size of the responses.
+func mergeSortedStreams(ctx context.Context, sources []io.Reader, desc bool, emit func(index int, line []byte) error) error {
+	h := &lineHeap{desc: desc}
+	for i, src := range sources {
+		c, err := newLineCursor(ctx, src, i)
+		if err != nil {
+			return err
+		}
+		if c.next() {
+			h.cursors = append(h.cursors, c)
+		} else if c.err != nil {
+			return c.err
+		}
+	}
+	heap.Init(h)
+
+	for n := 0; h.Len() > 0; n++ {
+		// checking every line would cost more than the merge itself
+		if n%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		c := h.cursors[0]
+		if err := emit(c.index, c.line); err != nil {
+			return err
+		}
+		if c.next() {
+			heap.Fix(h, 0)
+			continue
+		}
+		if c.err != nil {
+			return c.err
+		}
+		heap.Pop(h)
+	}
+	return nil
+}
+
+// lineCursor walks the lines of one endpoint response.
+type lineCursor struct {
+	r     *bufio.Reader
+	index int
+	err   error
+
+	line  []byte
+	raw   string
+	time  time.Time
+	valid bool
+}
+
+func newLineCursor(ctx context.Context, src io.Reader, index int) (*lineCursor, error) {
+	r := bufio.NewReader(src)
+	// arrays are turned into lines first, like by mergeData
+	if startsArray(r) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = mergeData(ctx, [][]byte{b}, NDJSON, Merge); err != nil {
+			return nil, err
+		}
+		r = bufio.NewReader(bytes.NewReader(b))
+	}
+	return &lineCursor{r: r, index: index}, nil
+}
+
+// startsArray reports whether the first non-space byte of r is '[', like
+// isArrayRooted, without consuming anything.
+func startsArray(r *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		p, _ := r.Peek(n)
+		if len(p) < n {
+			return false
+		}
+		if c := p[n-1]; c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c == '['
+		}
+	}
+}
+
+// next moves to the next non-empty line and decodes its _time. It reports
+// false at the end of the response or, with err set, if reading failed.
+func (c *lineCursor) next() bool {
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			c.err = err
+			return false
+		}
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry struct {
+				Time string `json:"_time"`
+			}
+			_ = json.Unmarshal(line, &entry)
+			c.line, c.raw = line, entry.Time
+			c.time, c.valid = parseLineTime(entry.Time)
+			return true
+		}
+		if err == io.EOF {
+			return false
+		}
+	}
+}
+
+func parseLineTime(s string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+// lineHeap orders cursors by the _time of their current line, like
+// compareTimestamps, and by endpoint for equal times.
+type lineHeap struct {
+	cursors []*lineCursor
+	desc    bool
+}
+
+func (h *lineHeap) Len() int      { return len(h.cursors) }
+func (h *lineHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *lineHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+	var c int
+	if a.valid && b.valid {
+		c = a.time.Compare(b.time)
+	} else {
+		c = strings.Compare(a.raw, b.raw)
+	}
+	if h.desc {
+		c = -c
+	}
+	if c != 0 {
+		return c < 0
+	}
+	return a.index < b.index
+}
+
+func (h *lineHeap) Push(x any) { h.cursors = append(h.cursors, x.(*lineCursor)) }
+
+func (h *lineHeap) Pop() any {
+	last := h.cursors[len(h.cursors)-1]
+	h.cursors = h.cursors[:len(h.cursors)-1]
+	return last
+}
+
+// streamsSorted reports whether the -sortByTime merge of route is written to
+// the client while the responses arrive. Paging, ETags, shared requests,
+// -maxMergedBytes, -mergeTimeout, -validateNDJSON, -minMergedRatio and the
+// merged sample of -debug need the whole merged response, it is buffered
+// for them.
+func streamsSorted(route Route, paging bool) bool {
+	return route.Format == NDJSON && opts.SortByTime != "" && route.Unwrap == "" &&
+		!paging && !opts.ETag && !opts.DedupRequests &&
+		opts.MaxMergedBytes <= 0 && opts.MergeTimeout <= 0 && opts.ValidateNDJSON == "" &&
+		opts.MinMergedRatio <= 0 && !(opts.Debug && opts.MergedSample > 0)
+}
+
+// sortedStreams are the open responses of a streamed -sortByTime merge.
+type sortedStreams struct {
+	results []endpointResult
+	failed  []endpointResult
+	source  bool
+}
+
+// openSortedStreams sends the request to all endpoints like forwardAndMerge
+// and applies the error policy to the responses, without reading the
+// successful ones.
+func openSortedStreams(r *http.Request, route Route, endpoints []Endpoint) (*sortedStreams, error) {
+	single := len(endpoints) == 1
+	endpoints, err := filterTenants(r, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err = filterTags(r, route.Tags, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	if route.Shard {
+		endpoints, err = shardEndpoint(r, route.Path, endpoints)
+		if err != nil {
+			return nil, err
+		}
+	}
+	source := wantsSource(r)
+
+	results, err := getEndpointStreams(r, backendPath(r, route), endpoints)
+	if err != nil {
+		return nil, err
+	}
+	// a single endpoint's error is passed through, status code included
+	if single && len(results) == 1 && results[0].StatusCode != 0 && results[0].Err != nil {
+		return nil, &backendError{StatusCode: results[0].StatusCode, Body: results[0].Body}
+	}
+	if err := commonQueryError(results); err != nil {
+		closeStreams(results)
+		return nil, err
+	}
+	_, failed, err := collectResults(results, route.Format)
+	if err != nil {
+		closeStreams(results)
+		return nil, err
+	}
+	results = slices.DeleteFunc(results, func(res endpointResult) bool { return res.Stream == nil })
+	return &sortedStreams{results: results, failed: failed, source: source}, nil
+}
+
+// write merges the streams into w, followed by the lines of the failed
+// endpoints, and closes them. Every buffered chunk is flushed to the client,
+// each within -writeTimeout. The status is sent with the first chunk, so a
+// failing stream aborts the response instead of ending it early.
+func (s *sortedStreams) write(w http.ResponseWriter, r *http.Request) {
+	defer closeStreams(s.results)
+
+	sources := make([]io.Reader, len(s.results))
+	for i, res := range s.results {
+		sources[i] = res.Stream
+	}
+	var seen map[string]bool
+	if len(opts.DedupKey) > 0 {
+		seen = map[string]bool{}
+	}
+	out := bufio.NewWriterSize(flushWriter{w: w, rc: http.NewResponseController(w)}, 32<<10)
+	err := mergeSortedStreams(r.Context(), sources, opts.SortByTime == "desc", func(i int, line []byte) error {
+		if seen != nil {
+			if key, ok := lineKey(line, opts.DedupKey); ok {
+				if seen[key] {
+					return nil
+				}
+				seen[key] = true
+			}
+		}
+		if s.source {
+			_, err := out.Write(injectSource(line, sourceLabel(s.results[i].Endpoint)))
+			return err
+		}
+		if _, err := out.Write(line); err != nil {
+			return err
+		}
+		return out.WriteByte('\n')
+	})
+	if err == nil {
+		var errLines []byte
+		if errLines, err = appendErrors(nil, NDJSON, s.failed); err == nil {
+			if _, err = out.Write(errLines); err == nil {
+				err = out.Flush()
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("failed to stream response: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// flushWriter sends every write to the client right away.
+type flushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	if opts.WriteTimeout > 0 {
+		if err := f.rc.SetWriteDeadline(time.Now().Add(opts.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("warning: failed to set write deadline: %v", err)
+		}
+	}
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
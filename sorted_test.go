@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeSortedLines(t *testing.T) {
+	a := `{"_time":"2024-01-01T00:00:01Z","_msg":"a1"}` + "\n" + `{"_time":"2024-01-01T00:00:03Z","_msg":"a3"}` + "\n"
+	b := `[{"_time":"2024-01-01T00:00:02Z","_msg":"b2"},{"_time":"2024-01-01T00:00:03Z","_msg":"b3"}]`
+	c := "\n" + `{"_time":"2024-01-01T00:00:00.5Z","_msg":"c0"}` + "\n\n"
+
+	got, err := mergeSortedLines(context.Background(), [][]byte{[]byte(a), []byte(b), []byte(c)}, false)
+	if err != nil {
+		t.Fatalf("mergeSortedLines() failed: %v", err)
+	}
+	want := []string{"c0", "a1", "b2", "a3", "b3"}
+	if msgs := lineMessages(t, got); !slices.Equal(msgs, want) {
+		t.Errorf("asc: got %v, want %v", msgs, want)
+	}
+
+	// descending inputs
+	a = `{"_time":"2024-01-01T00:00:03Z","_msg":"a3"}` + "\n" + `{"_time":"2024-01-01T00:00:01Z","_msg":"a1"}` + "\n"
+	b = `{"_time":"2024-01-01T00:00:02Z","_msg":"b2"}` + "\n"
+	got, err = mergeSortedLines(context.Background(), [][]byte{[]byte(a), []byte(b)}, true)
+	if err != nil {
+		t.Fatalf("mergeSortedLines() failed: %v", err)
+	}
+	want = []string{"a3", "b2", "a1"}
+	if msgs := lineMessages(t, got); !slices.Equal(msgs, want) {
+		t.Errorf("desc: got %v, want %v", msgs, want)
+	}
+}
+
+func TestMergeSortedStreams_large(t *testing.T) {
+	const (
+		endpoints = 4
+		lines     = 20000
+	)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sources := make([]io.Reader, endpoints)
+	readers := make([]*countingReader, endpoints)
+	for i := range sources {
+		var b bytes.Buffer
+		for j := range lines {
+			ts := start.Add(time.Duration(j*endpoints+i) * time.Millisecond)
+			fmt.Fprintf(&b, `{"_time":%q,"_msg":"line %d of %d"}`+"\n", ts.Format(time.RFC3339Nano), j, i)
+		}
+		readers[i] = &countingReader{r: &b}
+		sources[i] = readers[i]
+	}
+
+	// the merge may only read a buffer ahead of the lines it emitted,
+	// however large the responses are
+	emitted := make([]int, endpoints)
+	prev := time.Time{}
+	n := 0
+	err := mergeSortedStreams(context.Background(), sources, false, func(i int, line []byte) error {
+		emitted[i] += len(line) + 1
+		if ahead := readers[i].n - emitted[i]; ahead > 8<<10 {
+			t.Fatalf("read %d bytes ahead of endpoint %d", ahead, i)
+		}
+		var entry struct {
+			Time time.Time `json:"_time"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if entry.Time.Before(prev) {
+			t.Fatalf("line %d at %s after %s", n, entry.Time, prev)
+		}
+		prev = entry.Time
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("mergeSortedStreams() failed: %v", err)
+	}
+	if n != endpoints*lines {
+		t.Errorf("got %d lines, want %d", n, endpoints*lines)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestMakeJSONHandler_sortByTimeStream(t *testing.T) {
+	setOpts(t, func(o *Options) {
+		o.SortByTime = "asc"
+		o.DedupKey = []string{"_msg"}
+		o.NDJSONErrorPolicy = Include
+	})
+
+	var endpoints []Endpoint
+	for _, out := range []string{
+		"\ufeff" + `{"_time":"2024-01-01T00:00:01Z","_msg":"a1"}` + "\n" + `{"_time":"2024-01-01T00:00:04Z","_msg":"a4"}` + "\n",
+		`[{"_time":"2024-01-01T00:00:02Z","_msg":"b2"},{"_time":"2024-01-01T00:00:03Z","_msg":"a1"}]`,
+		`{"_time":"2024-01-01T00:00:00Z","_msg":"c0"}` + "\n\n" + `{"_time":"2024-01-01T00:00:03Z","_msg":"c3"}`,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, out)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: failing.URL})
+
+	route := Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/select/logsql/query?_source=1", bytes.NewBufferString("query=*"))
+	makeJSONHandler(route, endpoints).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d %q", rr.Code, rr.Body.String())
+	}
+	if !rr.Flushed {
+		t.Error("expected the merged lines to be flushed while merging")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines: %q", len(lines), rr.Body.String())
+	}
+	if want := `{"_error":`; !strings.HasPrefix(lines[5], want) || !strings.Contains(lines[5], "boom") {
+		t.Errorf("got last line %q, want the error of the failing endpoint", lines[5])
+	}
+	var msgs []string
+	for i, line := range lines[:5] {
+		var entry struct {
+			Source string `json:"_source"`
+			Msg    string `json:"_msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if !strings.HasPrefix(entry.Source, "http://127.0.0.1") {
+			t.Errorf("line %d: got _source %q", i, entry.Source)
+		}
+		msgs = append(msgs, entry.Msg)
+	}
+	if want := []string{"c0", "a1", "b2", "c3", "a4"}; !slices.Equal(msgs, want) {
+		t.Errorf("got %v, want %v", msgs, want)
+	}
+}
+
+func TestForwardAndMerge_sortByTime(t *testing.T) {
+	setOpts(t, func(o *Options) { o.SortByTime = "desc" })
+
+	var endpoints []Endpoint
+	for _, out := range []string{
+		`{"_time":"2024-01-01T00:00:04Z","_msg":"a4"}` + "\n" + `{"_time":"2024-01-01T00:00:01Z","_msg":"a1"}` + "\n",
+		`{"_time":"2024-01-01T00:00:03Z","_msg":"b3"}` + "\n" + `{"_time":"2024-01-01T00:00:02Z","_msg":"b2"}` + "\n",
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, out)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=* | sort by (_time desc)")))
+	got, err := forwardAndMerge(req, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	want := []string{"a4", "b3", "b2", "a1"}
+	if msgs := lineMessages(t, got); !slices.Equal(msgs, want) {
+		t.Errorf("got %v, want %v", msgs, want)
+	}
+}
+
+func lineMessages(t *testing.T, b []byte) []string {
+	t.Helper()
+	var msgs []string
+	for line := range strings.Lines(string(b)) {
+		var entry struct {
+			Msg string `json:"_msg"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		msgs = append(msgs, entry.Msg)
+	}
+	return msgs
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// wantsSource reports whether merged NDJSON lines should carry a _source
+// field, either for every request with -injectSource or per request with
+// _source=1. The parameter is never forwarded.
+func wantsSource(r *http.Request) bool {
+	values := takeQueryParam(r, "_source")
+	return opts.InjectSource || slices.Contains(values, "1")
+}
+
+// sourceLabel identifies the endpoint a line came from.
+func sourceLabel(ep Endpoint) string {
+	return redactURL(ep.URL) + " (" + ep.AccountID + ":" + ep.ProjectID + ")"
+}
+
+// injectSource adds "_source":source as first field to every NDJSON line
+// that is a JSON object. Other lines are kept unchanged.
+func injectSource(b []byte, source string) []byte {
+	field, _ := json.Marshal(source)
+	field = append([]byte(`"_source":`), field...)
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) < 2 || line[0] != '{' || !json.Valid(line) {
+			out.Write(scanner.Bytes())
+			out.WriteByte('\n')
+			continue
+		}
+		out.WriteByte('{')
+		out.Write(field)
+		if rest := bytes.TrimSpace(line[1:]); rest[0] != '}' {
+			out.WriteByte(',')
+		}
+		out.Write(line[1:])
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInjectSource(t *testing.T) {
+	in := `{"_msg":"a","level":"info"}` + "\n" + `not json` + "\n" + `{}` + "\n" + `[1,2]` + "\n" + ` {"_msg":"b"} `
+	want := `{"_source":"node1","_msg":"a","level":"info"}` + "\n" + `not json` + "\n" + `{"_source":"node1"}` + "\n" + `[1,2]` + "\n" + `{"_source":"node1","_msg":"b"}` + "\n"
+
+	if got := string(injectSource([]byte(in), "node1")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestForwardAndMerge_source(t *testing.T) {
+	var gotQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		_, err := io.WriteString(w, `{"_msg":"hello"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: server.URL},
+		{AccountID: "2", ProjectID: "p2", URL: server.URL},
+	}
+	route := Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}
+
+	req := httptest.NewRequest("POST", "/select/logsql/query?_source=1&limit=5", bytes.NewBuffer([]byte("query=*")))
+	got, err := forwardAndMerge(req, route, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	want := `{"_source":"` + server.URL + ` (1:p1)","_msg":"hello"}` + "\n" + `{"_source":"` + server.URL + ` (2:p2)","_msg":"hello"}` + "\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if gotQuery != "limit=5" {
+		t.Errorf("_source must not be forwarded, got query %q", gotQuery)
+	}
+
+	req = httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+	got, err = forwardAndMerge(req, route, endpoints)
+	if err != nil {
+		t.Fatalf("forwardAndMerge() failed: %v", err)
+	}
+	if strings.Contains(string(got), "_source") {
+		t.Errorf("unexpected _source without flag or parameter: %s", got)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startupCheckQuery is the trivial query sent to every endpoint by
+// -startupCheck.
+const startupCheckQuery = "query=*&limit=1"
+
+// checkTimeout bounds a check of an endpoint without timeout in -config and
+// without -requestTimeout, so an unresponsive node can't block it forever.
+const checkTimeout = 10 * time.Second
+
+// checkEndpoints sends a trivial query to every endpoint and returns the
+// error of each endpoint, nil for healthy ones.
+func checkEndpoints(ctx context.Context, endpoints []Endpoint) []error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(endpoints))
+	for i, ep := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = checkEndpoint(ctx, ep)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func checkEndpoint(ctx context.Context, ep Endpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(ep.Timeout, opts.RequestTimeout, checkTimeout))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ep.URL+"/select/logsql/query", strings.NewReader(startupCheckQuery))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("AccountID", ep.AccountID)
+	req.Header.Set("ProjectID", ep.ProjectID)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := ep.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("warning: failed to close response body: %v", err)
+		}
+	}()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// runStartupCheck checks all endpoints and logs the result. In "fail" mode
+// it returns an error if any endpoint failed, in "warn" mode it only logs.
+func runStartupCheck(mode string, endpoints []Endpoint) error {
+	var failed []error
+	for i, err := range checkEndpoints(context.Background(), endpoints) {
+		if err != nil {
+			log.Printf("startup check: %s failed: %v", endpoints[i], err)
+			failed = append(failed, err)
+			continue
+		}
+		log.Printf("startup check: %s OK", endpoints[i])
+	}
+	if len(failed) > 0 && mode == "fail" {
+		return fmt.Errorf("startup check failed for %d of %d endpoints: %w", len(failed), len(endpoints), errors.Join(failed...))
+	}
+	return nil
+}
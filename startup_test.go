@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRunStartupCheck(t *testing.T) {
+	var gotBody, gotAccount string
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody, gotAccount = string(b), r.Header.Get("AccountID")
+		_, err := io.WriteString(w, `{"_msg":"hello"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unknown tenant", http.StatusBadRequest)
+	}))
+	defer bad.Close()
+
+	endpoints := []Endpoint{
+		{AccountID: "1", ProjectID: "p1", URL: good.URL},
+		{AccountID: "2", ProjectID: "p2", URL: bad.URL},
+		{AccountID: "3", ProjectID: "p3", URL: "http://127.0.0.1:1"},
+	}
+
+	errs := checkEndpoints(context.Background(), endpoints)
+	if errs[0] != nil || errs[1] == nil || errs[2] == nil {
+		t.Errorf("unexpected check results: %v", errs)
+	}
+	if gotBody != startupCheckQuery || gotAccount != "1" {
+		t.Errorf("unexpected check request: body %q, AccountID %q", gotBody, gotAccount)
+	}
+
+	if err := runStartupCheck("warn", endpoints); err != nil {
+		t.Errorf("warn mode must not fail: %v", err)
+	}
+	if err := runStartupCheck("fail", endpoints); err == nil {
+		t.Error("fail mode must fail with bad endpoints")
+	}
+	if err := runStartupCheck("fail", endpoints[:1]); err != nil {
+		t.Errorf("fail mode must pass with good endpoints: %v", err)
+	}
+}
+
+func TestCheckEndpoints_timeout(t *testing.T) {
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client leaving once the body is read
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			t.Errorf("failed reading body: %v", err)
+		}
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+
+	start := time.Now()
+	errs := checkEndpoints(context.Background(), []Endpoint{{AccountID: "1", ProjectID: "p1", URL: hanging.URL, Timeout: 50 * time.Millisecond}})
+	if !errors.Is(errs[0], context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", errs[0])
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("check of an unresponsive endpoint took %v", d)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type timingsKey struct{}
+
+// endpointTimings collects the backend durations of one client request for
+// the Server-Timing header.
+type endpointTimings struct {
+	mu      sync.Mutex
+	entries []endpointTiming
+}
+
+type endpointTiming struct {
+	Endpoint Endpoint
+	Duration time.Duration
+}
+
+// withTimings returns r with a context that collects endpoint durations.
+func withTimings(r *http.Request) (*http.Request, *endpointTimings) {
+	t := &endpointTimings{}
+	return r.WithContext(context.WithValue(r.Context(), timingsKey{}, t)), t
+}
+
+// recordTimings adds the durations of results to the collector of ctx, if
+// any. Endpoints skipped by the circuit breaker were not queried and are left
+// out.
+func recordTimings(ctx context.Context, results []endpointResult) {
+	t, ok := ctx.Value(timingsKey{}).(*endpointTimings)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, res := range results {
+		if res.Err == errCircuitOpen {
+			continue
+		}
+		t.entries = append(t.entries, endpointTiming{Endpoint: res.Endpoint, Duration: res.Duration})
+	}
+}
+
+// header formats the durations as Server-Timing value, one metric per
+// endpoint with the endpoint as description.
+func (t *endpointTimings) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parts := make([]string, 0, len(t.entries))
+	for i, e := range t.entries {
+		ms := strconv.FormatFloat(float64(e.Duration)/float64(time.Millisecond), 'f', 1, 64)
+		parts = append(parts, fmt.Sprintf("ep%d;desc=%s;dur=%s", i, strconv.Quote(sourceLabel(e.Endpoint)), ms))
+	}
+	return strings.Join(parts, ", ")
+}
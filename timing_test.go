@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMakeJSONHandler_serverTiming(t *testing.T) {
+	var endpoints []Endpoint
+	for _, tenant := range []string{"1", "2"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, `{"n":1}`+"\n")
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: tenant, ProjectID: "p", URL: server.URL})
+	}
+	handler := makeJSONHandler(Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*"))))
+	if h := rr.Header().Get("Server-Timing"); h != "" {
+		t.Errorf("unexpected Server-Timing without -backendTimeoutHeader: %s", h)
+	}
+
+	setOpts(t, func(o *Options) { o.BackendTimeoutHeader = true })
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*"))))
+
+	entries := strings.Split(rr.Header().Get("Server-Timing"), ", ")
+	if len(entries) != len(endpoints) {
+		t.Fatalf("expected %d Server-Timing entries, got %q", len(endpoints), entries)
+	}
+	for _, ep := range endpoints {
+		found := false
+		for _, e := range entries {
+			if strings.Contains(e, `desc="`+sourceLabel(ep)+`"`) && strings.Contains(e, ";dur=") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no Server-Timing entry for %s in %q", ep, entries)
+		}
+	}
+}
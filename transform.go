@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Transform reshapes the merged JSON response of a route, e.g. to rename
+// fields, without touching the merge itself. Routes refer to transforms by
+// name with transforms in the config file.
+type Transform func(merged []byte) ([]byte, error)
+
+// transforms holds the transforms available to routes, see
+// registerTransform.
+var transforms = map[string]Transform{
+	"sortValues": sortValues,
+}
+
+// registerTransform makes t available to routes under name. It must be
+// called before the config file is loaded, e.g. from an init function.
+func registerTransform(name string, t Transform) {
+	if _, ok := transforms[name]; ok {
+		panic(fmt.Sprintf("transform %s registered twice", name))
+	}
+	transforms[name] = t
+}
+
+// applyTransforms runs the named transforms on merged in order. Empty
+// results are returned as they are.
+func applyTransforms(merged []byte, names []string) ([]byte, error) {
+	if len(bytes.TrimSpace(merged)) == 0 {
+		return merged, nil
+	}
+	for _, name := range names {
+		t, ok := transforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %s", name)
+		}
+		var err error
+		if merged, err = t(merged); err != nil {
+			return nil, fmt.Errorf("transform %s: %w", name, err)
+		}
+	}
+	return merged, nil
+}
+
+// ValueSort orders the values[] entries of merged responses by Key, "hits"
+// or "value". Entries equal in Key are ordered by the other one, hits
+// highest first and values ascending.
+type ValueSort struct {
+	Key  string
+	Desc bool
+}
+
+func (s ValueSort) String() string {
+	if s.Key == "" {
+		return ""
+	}
+	if s.Desc {
+		return s.Key + ":desc"
+	}
+	return s.Key + ":asc"
+}
+
+// UnmarshalText parses a key with an optional direction, e.g. value:asc or
+// hits. Without direction hits sort descending and values ascending.
+func (s *ValueSort) UnmarshalText(text []byte) error {
+	key, dir, hasDir := strings.Cut(string(text), ":")
+	if key != "hits" && key != "value" {
+		return fmt.Errorf("unknown sort key %q, use hits or value", key)
+	}
+	desc := key == "hits"
+	if hasDir {
+		switch dir {
+		case "asc":
+			desc = false
+		case "desc":
+			desc = true
+		default:
+			return fmt.Errorf("unknown sort direction %q, use asc or desc", dir)
+		}
+	}
+	*s = ValueSort{Key: key, Desc: desc}
+	return nil
+}
+
+// requestedSort returns the sort of values[] asked for with the _sortValues
+// query parameter, e.g. _sortValues=value:asc, or else the sort of the
+// route. The parameter is not forwarded.
+func requestedSort(r *http.Request, route ValueSort) (ValueSort, error) {
+	values := takeQueryParam(r, "_sortValues")
+	if len(values) == 0 {
+		return route, nil
+	}
+	var s ValueSort
+	if err := s.UnmarshalText([]byte(values[len(values)-1])); err != nil {
+		return ValueSort{}, fmt.Errorf("_sortValues: %w", err)
+	}
+	return s, nil
+}
+
+// sortValues orders the values[] entries of a field_values-like response by
+// hits, highest first, and by value for equal hits. The sum strategy returns
+// them in the order they were first seen.
+func sortValues(merged []byte) ([]byte, error) {
+	return sortValuesBy(merged, ValueSort{Key: "hits", Desc: true})
+}
+
+// sortValuesBy orders the values[] entries of a field_values-like response
+// as s says. Responses without values[] or a zero s return merged as it is.
+func sortValuesBy(merged []byte, s ValueSort) ([]byte, error) {
+	if s.Key == "" {
+		return merged, nil
+	}
+	var obj map[string]json.RawMessage
+	if isArrayRooted(merged) || json.Unmarshal(merged, &obj) != nil || obj["values"] == nil {
+		return merged, nil
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(obj["values"], &values); err != nil {
+		return merged, nil
+	}
+
+	type entry struct {
+		raw     json.RawMessage
+		hits    json.Number
+		value   string
+		num     json.Number
+		numeric bool
+	}
+	entries := make([]entry, 0, len(values))
+	for _, raw := range values {
+		var item struct {
+			Hits  json.Number     `json:"hits"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return merged, nil
+		}
+		value, err := valueKey(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		num, numeric := numericValue(value)
+		entries = append(entries, entry{raw: raw, hits: cmp.Or(item.Hits, "0"), value: value, num: num, numeric: numeric})
+	}
+	slices.SortStableFunc(entries, func(a, b entry) int {
+		byHits := compareNumbers(b.hits, a.hits)
+		// numeric values sort by number and before all others
+		var byValue int
+		switch {
+		case a.numeric && b.numeric:
+			byValue = cmp.Or(compareNumbers(a.num, b.num), cmp.Compare(a.value, b.value))
+		case a.numeric:
+			byValue = -1
+		case b.numeric:
+			byValue = 1
+		default:
+			byValue = cmp.Compare(a.value, b.value)
+		}
+		primary, secondary := byHits, byValue
+		if s.Key == "value" {
+			primary, secondary = byValue, byHits
+		}
+		// hits sort descending and values ascending unless s says otherwise
+		if s.Desc != (s.Key == "hits") {
+			primary = -primary
+		}
+		return cmp.Or(primary, secondary)
+	})
+
+	for i, e := range entries {
+		values[i] = e.raw
+	}
+	sorted, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	obj["values"] = sorted
+	return json.Marshal(obj)
+}
+
+// numericValue returns the number in the compact JSON value key, a number
+// or a string holding one, as VictoriaLogs returns field values as strings.
+func numericValue(key string) (json.Number, bool) {
+	var s string
+	if json.Unmarshal([]byte(key), &s) == nil {
+		key = s
+	}
+	var n json.Number
+	if err := json.Unmarshal([]byte(key), &n); err != nil || n == "" {
+		return "", false
+	}
+	return n, true
+}
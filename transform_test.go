@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSortValues(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{"values":[{"value":"b","hits":1},{"value":"c","hits":10.5},{"value":"a","hits":1},{"value":"d","hits":3}]}`,
+			`{"values":[{"value":"c","hits":10.5},{"value":"d","hits":3},{"value":"a","hits":1},{"value":"b","hits":1}]}`},
+		{`{"other":1}`, `{"other":1}`},
+		{`[{"hits":1},{"hits":2}]`, `[{"hits":1},{"hits":2}]`},
+		{`{"values":"not a list"}`, `{"values":"not a list"}`},
+	}
+	for _, tt := range tests {
+		got, err := sortValues([]byte(tt.in))
+		if err != nil {
+			t.Fatalf("%s: sortValues() failed: %v", tt.in, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestApplyRouteOverrides_transforms(t *testing.T) {
+	defer delete(transforms, "renameValues")
+	registerTransform("renameValues", func(merged []byte) ([]byte, error) {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(merged, &obj); err != nil {
+			return nil, err
+		}
+		obj["items"] = obj["values"]
+		delete(obj, "values")
+		return json.Marshal(obj)
+	})
+
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/field_values": {"transforms": ["sortValues", "renameValues"]}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	got, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+	var route Route
+	for _, r := range got {
+		if r.Path == "/select/logsql/field_values" {
+			route = r
+		}
+	}
+
+	var endpoints []Endpoint
+	for _, out := range []string{
+		`{"values":[{"value":"A","hits":1},{"value":"B","hits":5}]}`,
+		`{"values":[{"value":"A","hits":1},{"value":"C","hits":3}]}`,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.WriteString(w, out)
+			if err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	req := httptest.NewRequest("POST", route.Path, bytes.NewBuffer([]byte("query=*")))
+	rr := httptest.NewRecorder()
+	makeJSONHandler(route, endpoints).ServeHTTP(rr, req)
+	want := `{"items":[{"hits":5,"value":"B"},{"hits":3,"value":"C"},{"hits":2,"value":"A"}]}`
+	if rr.Body.String() != want {
+		t.Errorf("got %s, want %s", rr.Body.String(), want)
+	}
+
+	cfg, err = loadConfig(writeConfig(t, `{"routes": {"/select/logsql/field_values": {"transforms": ["roundHits"]}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	if _, err := applyRouteOverrides(routes, cfg); err == nil || !strings.Contains(err.Error(), "unknown transform roundHits") {
+		t.Errorf("expected unknown transform error, got %v", err)
+	}
+}
+
+func TestSortValuesBy(t *testing.T) {
+	const in = `{"values":[{"value":"b","hits":1},{"value":"c","hits":10},{"value":"a","hits":1},{"value":"d","hits":3}]}`
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"hits", `{"values":[{"value":"c","hits":10},{"value":"d","hits":3},{"value":"a","hits":1},{"value":"b","hits":1}]}`},
+		{"hits:asc", `{"values":[{"value":"a","hits":1},{"value":"b","hits":1},{"value":"d","hits":3},{"value":"c","hits":10}]}`},
+		{"value", `{"values":[{"value":"a","hits":1},{"value":"b","hits":1},{"value":"c","hits":10},{"value":"d","hits":3}]}`},
+		{"value:desc", `{"values":[{"value":"d","hits":3},{"value":"c","hits":10},{"value":"b","hits":1},{"value":"a","hits":1}]}`},
+	}
+	for _, tt := range tests {
+		var s ValueSort
+		if err := s.UnmarshalText([]byte(tt.sort)); err != nil {
+			t.Fatalf("%s: UnmarshalText() failed: %v", tt.sort, err)
+		}
+		got, err := sortValuesBy([]byte(in), s)
+		if err != nil {
+			t.Fatalf("%s: sortValuesBy() failed: %v", tt.sort, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.sort, got, tt.want)
+		}
+	}
+
+	// numbers sort numerically, before values that are no numbers
+	const numbers = `{"values":[{"value":"100","hits":1},{"value":"b","hits":1},{"value":9,"hits":1},{"value":"10","hits":1},{"value":"-2.5","hits":1}]}`
+	var s ValueSort
+	if err := s.UnmarshalText([]byte("value")); err != nil {
+		t.Fatalf("UnmarshalText() failed: %v", err)
+	}
+	got, err := sortValuesBy([]byte(numbers), s)
+	if err != nil {
+		t.Fatalf("numbers: sortValuesBy() failed: %v", err)
+	}
+	if want := `{"values":[{"value":"-2.5","hits":1},{"value":9,"hits":1},{"value":"10","hits":1},{"value":"100","hits":1},{"value":"b","hits":1}]}`; string(got) != want {
+		t.Errorf("numbers: got %s, want %s", got, want)
+	}
+
+	for _, invalid := range []string{"", "count", "hits:up"} {
+		var s ValueSort
+		if err := s.UnmarshalText([]byte(invalid)); err == nil {
+			t.Errorf("expected error for sort %q", invalid)
+		}
+	}
+}
+
+func TestForwardAndMerge_sortValues(t *testing.T) {
+	var endpoints []Endpoint
+	for _, out := range []string{
+		`{"values":[{"value":"A","hits":1},{"value":"B","hits":5}]}`,
+		`{"values":[{"value":"A","hits":1},{"value":"C","hits":3}]}`,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.RawQuery, "_sortValues") {
+				t.Errorf("_sortValues forwarded: %s", r.URL.RawQuery)
+			}
+			if _, err := io.WriteString(w, out); err != nil {
+				t.Errorf("failed responding: %v", err)
+			}
+		}))
+		defer server.Close()
+		endpoints = append(endpoints, Endpoint{AccountID: "1", ProjectID: "p1", URL: server.URL})
+	}
+
+	cfg, err := loadConfig(writeConfig(t, `{"routes": {"/select/logsql/field_values": {"sortValues": "value:asc"}}}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+	got, err := applyRouteOverrides(routes, cfg)
+	if err != nil {
+		t.Fatalf("applyRouteOverrides() failed: %v", err)
+	}
+	i := slices.IndexFunc(got, func(r Route) bool { return r.Path == "/select/logsql/field_values" })
+	route := got[i]
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/select/logsql/field_values", `{"values":[{"hits":2,"value":"A"},{"hits":5,"value":"B"},{"hits":3,"value":"C"}]}`},
+		{"/select/logsql/field_values?_sortValues=hits:desc", `{"values":[{"hits":5,"value":"B"},{"hits":3,"value":"C"},{"hits":2,"value":"A"}]}`},
+		{"/select/logsql/field_values?_sortValues=value:desc", `{"values":[{"hits":3,"value":"C"},{"hits":5,"value":"B"},{"hits":2,"value":"A"}]}`},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.target, bytes.NewBufferString("query=*"))
+		merged, err := forwardAndMerge(req, route, endpoints)
+		if err != nil {
+			t.Fatalf("%s: forwardAndMerge() failed: %v", tt.target, err)
+		}
+		if string(merged) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.target, merged, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/select/logsql/field_values?_sortValues=count", bytes.NewBufferString("query=*"))
+	if _, err := forwardAndMerge(req, route, endpoints); err == nil {
+		t.Error("expected error for unknown _sortValues")
+	}
+}
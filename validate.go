@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+)
+
+// validateLines checks every NDJSON line of an endpoint response for valid
+// JSON. With -validateNDJSON=drop invalid lines are removed, with =flag they
+// are replaced by {"_invalid":"<line>"}. Either way a warning is logged.
+// Array-rooted bodies are parsed as a whole by mergeData and kept as is.
+func validateLines(b []byte, mode string, ep Endpoint) []byte {
+	if isArrayRooted(b) {
+		return b
+	}
+
+	var (
+		out     bytes.Buffer
+		invalid int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 || json.Valid(line) {
+			out.Write(line)
+			out.WriteByte('\n')
+			continue
+		}
+
+		invalid++
+		if mode == "flag" {
+			flagged, _ := json.Marshal(map[string]string{"_invalid": string(line)})
+			out.Write(flagged)
+			out.WriteByte('\n')
+		}
+	}
+	if invalid > 0 {
+		log.Printf("warning: %s returned %d invalid NDJSON lines", ep, invalid)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestForwardAndMerge_validateNDJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, `{"_msg":"ok"}`+"\n"+`{"_msg":"cut`+"\n"+`garbage`+"\n"+`{"_msg":"also ok"}`+"\n")
+		if err != nil {
+			t.Errorf("failed responding: %v", err)
+		}
+	}))
+	defer server.Close()
+	endpoints := []Endpoint{{AccountID: "1", ProjectID: "p1", URL: server.URL}}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", `{"_msg":"ok"}` + "\n" + `{"_msg":"cut` + "\n" + `garbage` + "\n" + `{"_msg":"also ok"}` + "\n"},
+		{"drop", `{"_msg":"ok"}` + "\n" + `{"_msg":"also ok"}` + "\n"},
+		{"flag", `{"_msg":"ok"}` + "\n" + `{"_invalid":"{\"_msg\":\"cut"}` + "\n" + `{"_invalid":"garbage"}` + "\n" + `{"_msg":"also ok"}` + "\n"},
+	}
+	for _, tt := range tests {
+		setOpts(t, func(o *Options) { o.ValidateNDJSON = tt.mode })
+		logs.Reset()
+
+		req := httptest.NewRequest("POST", "/select/logsql/query", bytes.NewBuffer([]byte("query=*")))
+		got, err := forwardAndMerge(req, Route{Path: "/select/logsql/query", Format: NDJSON, MergeStrategy: Merge}, endpoints)
+		if err != nil {
+			t.Fatalf("%q: forwardAndMerge() failed: %v", tt.mode, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.mode, got, tt.want)
+		}
+		if warned := strings.Contains(logs.String(), "2 invalid NDJSON lines"); warned != (tt.mode != "") {
+			t.Errorf("%q: unexpected warning log %q", tt.mode, logs.String())
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "v1.2.3", "abc123"
+
+	rr := httptest.NewRecorder()
+	newMux(nil, nil).ServeHTTP(rr, httptest.NewRequest("GET", "/-/version", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var got buildInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v\nraw: %s", err, rr.Body.String())
+	}
+	want := buildInfo{Version: "v1.2.3", Commit: "abc123", GoVersion: runtime.Version()}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCurrentBuild_defaults(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "dev", ""
+
+	got := currentBuild()
+	if got.Version != "dev" || got.Commit == "" {
+		t.Errorf("expected dev version with a fallback commit, got %+v", got)
+	}
+}